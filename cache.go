@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	internalCfg "github.com/eryalito/multi-wordpress-file-manager/internal/config"
+	"github.com/eryalito/multi-wordpress-file-manager/internal/worker"
+	publicCfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// runCache implements "mwpfm cache purge [-config path] [-all] [domain...]".
+func runCache(args []string) int {
+	if len(args) == 0 || args[0] != "purge" {
+		fmt.Fprintln(os.Stderr, "usage: mwpfm cache purge [-config path] [-all] [domain...]")
+		return 2
+	}
+	fs := flag.NewFlagSet("cache purge", flag.ContinueOnError)
+	cfgPath := fs.String("config", "config.yaml", "Path to YAML configuration file")
+	all := fs.Bool("all", false, "Purge the cache of every site")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if !*all && fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "cache purge: no domain given (use -all to purge every site)")
+		return 2
+	}
+
+	cfg, err := internalCfg.Load(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cache purge: %v\n", err)
+		return 1
+	}
+	manager, err := worker.NewProxyManager(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cache purge: %v\n", err)
+		return 1
+	}
+
+	wanted := map[string]bool{}
+	for _, d := range fs.Args() {
+		wanted[d] = true
+	}
+	status := 0
+	// The cache is kept per domain, by the vhost of its primary site.
+	for _, group := range publicCfg.GroupByDomain(cfg.Sites) {
+		site := group[0]
+		if !*all && !wanted[site.DomainName] {
+			continue
+		}
+		delete(wanted, site.DomainName)
+		if err := manager.PurgeCache(site); err != nil {
+			fmt.Fprintf(os.Stderr, "cache purge: %s: %v\n", site.DomainName, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("purged %s\n", site.DomainName)
+	}
+	for d := range wanted {
+		fmt.Fprintf(os.Stderr, "cache purge: %s is not a configured site\n", d)
+		status = 1
+	}
+	return status
+}
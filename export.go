@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	internalCfg "github.com/eryalito/multi-wordpress-file-manager/internal/config"
+	"github.com/eryalito/multi-wordpress-file-manager/internal/export"
+	publicCfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+const exportUsage = "usage: mwpfm export ingress|httproute|traefik [-config path] [flags]"
+
+// runExport implements "mwpfm export <kind>", printing routing manifests for
+// the configured sites to stdout.
+func runExport(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, exportUsage)
+		return 2
+	}
+	kind := args[0]
+	fs := flag.NewFlagSet("export "+kind, flag.ContinueOnError)
+	cfgPath := fs.String("config", "config.yaml", "Path to YAML configuration file")
+	var o export.Options
+	fs.StringVar(&o.Name, "name", "multi-wordpress", "Name of the generated object")
+	fs.StringVar(&o.Namespace, "namespace", "", "Namespace of the generated object")
+	fs.StringVar(&o.Service, "service", "multi-wordpress", "Service the hosts are routed to")
+	fs.IntVar(&o.Port, "port", 80, "Port of the service")
+	fs.StringVar(&o.IngressClass, "class", "", "Ingress class name (ingress)")
+	fs.BoolVar(&o.TLS, "tls", false, "Add a TLS entry per domain (ingress)")
+	fs.StringVar(&o.TLSSecret, "tls-secret", "", "Secret used by every TLS entry instead of one per domain (ingress)")
+	fs.StringVar(&o.Gateway, "gateway", "", "Parent gateway (httproute)")
+	fs.StringVar(&o.GatewayNamespace, "gateway-namespace", "", "Namespace of the parent gateway (httproute)")
+	url := fs.String("url", "", "Address of the proxy; defaults to proxy.traefik.url or the service (traefik)")
+	entryPoints := fs.String("entry-points", "", "Comma-separated entry points; defaults to proxy.traefik.entry_points (traefik)")
+	certResolver := fs.String("cert-resolver", "", "Certificate resolver; defaults to proxy.traefik.cert_resolver (traefik)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	cfg, err := internalCfg.Load(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 1
+	}
+
+	var out []byte
+	switch kind {
+	case "ingress":
+		out, err = export.Ingress(cfg, o)
+	case "httproute":
+		if o.Gateway == "" {
+			fmt.Fprintln(os.Stderr, "export httproute: -gateway is required")
+			return 2
+		}
+		out, err = export.HTTPRoute(cfg, o)
+	case "traefik":
+		var t publicCfg.Traefik
+		if cfg.Proxy.Traefik != nil {
+			t = *cfg.Proxy.Traefik
+		}
+		if *url != "" {
+			t.URL = *url
+		}
+		if t.URL == "" {
+			t.URL = fmt.Sprintf("http://%s:%d", o.Service, o.Port)
+		}
+		if *entryPoints != "" {
+			t.EntryPoints = strings.Split(*entryPoints, ",")
+		}
+		if *certResolver != "" {
+			t.CertResolver = *certResolver
+		}
+		out, err = export.Traefik(cfg, t)
+	default:
+		fmt.Fprintln(os.Stderr, exportUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export %s: %v\n", kind, err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
@@ -0,0 +1,230 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/eryalito/multi-wordpress-file-manager/internal/lock"
+)
+
+// lockTimeout bounds how long an issuer waits for another replica that is
+// currently ordering certificates.
+const lockTimeout = 5 * time.Minute
+
+// ACMEIssuer obtains certificates from an ACME CA using HTTP-01 challenges.
+// Challenge responses are written to ChallengeDir, which the proxy serves at
+// /.well-known/acme-challenge/ for the domains being validated.
+type ACMEIssuer struct {
+	// DirectoryURL of the CA; Let's Encrypt production if empty.
+	DirectoryURL string
+	// Email registered as the account contact (optional).
+	Email string
+	// CAFile is an extra PEM bundle to trust when talking to the CA, such as
+	// the root of a local Pebble test server.
+	CAFile string
+	// StateDir holds the account key, the challenge directory and the lock
+	// file, and must be on storage shared by all replicas.
+	StateDir string
+	// Member identifies this instance in the lock sidecar.
+	Member string
+}
+
+// ChallengeDir returns the directory holding HTTP-01 challenge responses.
+func (i *ACMEIssuer) ChallengeDir() string {
+	return filepath.Join(i.StateDir, "challenges")
+}
+
+// Obtain orders a certificate covering names and stores it in dir. Only one
+// replica orders at a time; if another one issued a current certificate while
+// this one was waiting for the lock, that certificate is used instead. The
+// certificate is only written if the lock carried by ctx is still held once
+// the order completes.
+func (i *ACMEIssuer) Obtain(ctx context.Context, dir string, names []string) (certFile, keyFile string, err error) {
+	certFile, keyFile = filepath.Join(dir, CertFileName), filepath.Join(dir, KeyFileName)
+
+	lockCtx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+	l, err := lock.Acquire(lockCtx, filepath.Join(i.StateDir, "order.lock"), i.Member, lock.Options{})
+	if err != nil {
+		return "", "", fmt.Errorf("acquire acme lock: %w", err)
+	}
+	defer l.Release()
+
+	if !NeedsRenewal(certFile, keyFile, names) {
+		return certFile, keyFile, nil
+	}
+
+	client, err := i.client(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return "", "", fmt.Errorf("create order: %w", err)
+	}
+	for _, u := range order.AuthzURLs {
+		if err := i.authorize(ctx, client, u); err != nil {
+			return "", "", err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return "", "", fmt.Errorf("wait order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("generate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	if err != nil {
+		return "", "", fmt.Errorf("create csr: %w", err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return "", "", fmt.Errorf("finalize order: %w", err)
+	}
+
+	certPEM, keyPEM, err := encode(chain[0], key)
+	if err != nil {
+		return "", "", err
+	}
+	for _, der := range chain[1:] {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := l.CheckFence(ctx); err != nil {
+		return "", "", fmt.Errorf("acme lock: %w", err)
+	}
+	if err := lock.CheckFence(ctx); err != nil {
+		return "", "", err
+	}
+	if err := writePair(certFile, keyFile, certPEM, keyPEM); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// authorize completes the HTTP-01 challenge of a single authorization.
+func (i *ACMEIssuer) authorize(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("get authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	resp, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return fmt.Errorf("challenge response: %w", err)
+	}
+	if err := os.MkdirAll(i.ChallengeDir(), 0o755); err != nil {
+		return fmt.Errorf("create challenge dir: %w", err)
+	}
+	tokenPath := filepath.Join(i.ChallengeDir(), chal.Token)
+	if err := os.WriteFile(tokenPath, []byte(resp), 0o644); err != nil {
+		return fmt.Errorf("write challenge response: %w", err)
+	}
+	defer os.Remove(tokenPath)
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accept challenge for %s: %w", authz.Identifier.Value, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorize %s: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// client returns an ACME client for the configured directory, registering the
+// account on first use.
+func (i *ACMEIssuer) client(ctx context.Context) (*acme.Client, error) {
+	key, err := i.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: i.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+	if i.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(i.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read acme ca file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", i.CAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	account := &acme.Account{}
+	if i.Email != "" {
+		account.Contact = []string{"mailto:" + i.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("register acme account: %w", err)
+	}
+	return client, nil
+}
+
+// accountKey loads the account key from the state directory, creating it on
+// first use so every replica shares the same account.
+func (i *ACMEIssuer) accountKey() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(i.StateDir, "account.key")
+	data, err := os.ReadFile(path)
+	if err == nil {
+		b, _ := pem.Decode(data)
+		if b == nil {
+			return nil, fmt.Errorf("invalid PEM data in %s", path)
+		}
+		return x509.ParseECPrivateKey(b.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read account key: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate account key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal account key: %w", err)
+	}
+	if err := os.MkdirAll(i.StateDir, 0o700); err != nil {
+		return nil, fmt.Errorf("create acme dir: %w", err)
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, fmt.Errorf("write account key: %w", err)
+	}
+	return key, nil
+}
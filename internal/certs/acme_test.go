@@ -0,0 +1,76 @@
+package certs
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestObtainPebble orders a certificate from a Pebble test CA. It runs only
+// when MWPFM_PEBBLE_DIRECTORY is set to Pebble's directory URL, e.g.
+//
+//	pebble -config test/config/pebble-config.json &
+//	MWPFM_PEBBLE_DIRECTORY=https://localhost:14000/dir \
+//	MWPFM_PEBBLE_CA=test/certs/pebble.minica.pem \
+//	go test ./internal/certs -run Pebble
+//
+// The test answers HTTP-01 challenges on MWPFM_PEBBLE_HTTP_ADDR (":5002",
+// Pebble's default validation port, if unset) for MWPFM_PEBBLE_DOMAIN
+// ("localhost" if unset), which Pebble must resolve to this host.
+func TestObtainPebble(t *testing.T) {
+	directory := os.Getenv("MWPFM_PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("MWPFM_PEBBLE_DIRECTORY not set")
+	}
+	addr := envOr("MWPFM_PEBBLE_HTTP_ADDR", ":5002")
+	domain := envOr("MWPFM_PEBBLE_DOMAIN", "localhost")
+
+	i := &ACMEIssuer{
+		DirectoryURL: directory,
+		CAFile:       os.Getenv("MWPFM_PEBBLE_CA"),
+		StateDir:     t.TempDir(),
+		Member:       "test",
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/.well-known/acme-challenge/", http.StripPrefix("/.well-known/acme-challenge/", http.FileServer(http.Dir(i.ChallengeDir()))))
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	dir := t.TempDir()
+	names := []string{domain}
+	certFile, keyFile, err := i.Obtain(ctx, dir, names)
+	if err != nil {
+		t.Fatalf("Obtain: %v", err)
+	}
+	if err := Validate(certFile, keyFile, names); err != nil {
+		t.Fatalf("issued certificate invalid: %v", err)
+	}
+	if _, n := readLeaf(t, certFile); n < 2 {
+		t.Errorf("chain has %d certificate(s), want the intermediate too", n)
+	}
+	if entries, _ := os.ReadDir(i.ChallengeDir()); len(entries) != 0 {
+		t.Errorf("challenge responses left behind: %d", len(entries))
+	}
+	if _, err := os.Stat(filepath.Join(i.StateDir, "account.key")); err != nil {
+		t.Errorf("account key not stored: %v", err)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,57 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// File names used inside a TLS directory, matching kubernetes.io/tls secrets.
+const (
+	CertFileName = "tls.crt"
+	KeyFileName  = "tls.key"
+)
+
+// Files resolves the certificate and key paths configured for a site.
+func Files(t cfg.TLS) (certFile, keyFile string, err error) {
+	switch {
+	case t.CertFile != "" && t.KeyFile != "":
+		return t.CertFile, t.KeyFile, nil
+	case t.Dir != "":
+		return filepath.Join(t.Dir, CertFileName), filepath.Join(t.Dir, KeyFileName), nil
+	default:
+		return "", "", errors.New("tls requires cert_file and key_file, or dir")
+	}
+}
+
+// Validate checks that certFile and keyFile hold a parseable certificate chain
+// with a matching private key, that the leaf certificate is currently valid and
+// that it covers every name in names.
+func Validate(certFile, keyFile string, names []string) error {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parse certificate: %w", err)
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate not valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	for _, name := range names {
+		if err := leaf.VerifyHostname(name); err != nil {
+			return fmt.Errorf("certificate does not cover %s: %w", name, err)
+		}
+	}
+	return nil
+}
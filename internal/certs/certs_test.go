@@ -0,0 +1,91 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/fs"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a self-signed certificate for names valid from
+// notBefore to notAfter into dir, returning its certificate and key paths.
+func writeSelfSigned(t *testing.T, dir string, names []string, notBefore, notAfter time.Time) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := encode(der, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, CertFileName), filepath.Join(dir, KeyFileName)
+	if err := writePair(certFile, keyFile, certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		certFor []string
+		from    time.Duration
+		to      time.Duration
+		names   []string
+		// otherKey replaces the key with that of another certificate.
+		otherKey bool
+		wantErr  string
+	}{
+		{name: "valid", certFor: []string{"example.com", "www.example.com"}, from: -time.Hour, to: time.Hour, names: []string{"example.com", "www.example.com"}},
+		{name: "wildcard", certFor: []string{"*.example.com"}, from: -time.Hour, to: time.Hour, names: []string{"a.example.com"}},
+		{name: "expired", certFor: []string{"example.com"}, from: -2 * time.Hour, to: -time.Hour, names: []string{"example.com"}, wantErr: "expired"},
+		{name: "not yet valid", certFor: []string{"example.com"}, from: time.Hour, to: 2 * time.Hour, names: []string{"example.com"}, wantErr: "not valid before"},
+		{name: "missing name", certFor: []string{"example.com"}, from: -time.Hour, to: time.Hour, names: []string{"example.com", "other.com"}, wantErr: "does not cover other.com"},
+		{name: "key mismatch", certFor: []string{"example.com"}, from: -time.Hour, to: time.Hour, names: []string{"example.com"}, otherKey: true, wantErr: "load key pair"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile, keyFile := writeSelfSigned(t, dir, tt.certFor, now.Add(tt.from), now.Add(tt.to))
+			if tt.otherKey {
+				_, keyFile = writeSelfSigned(t, t.TempDir(), tt.certFor, now.Add(tt.from), now.Add(tt.to))
+			}
+			err := Validate(certFile, keyFile, tt.names)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	err := Validate(filepath.Join(dir, CertFileName), filepath.Join(dir, KeyFileName), []string{"example.com"})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Validate = %v, want a missing file error", err)
+	}
+}
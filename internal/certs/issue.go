@@ -0,0 +1,296 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/eryalito/multi-wordpress-file-manager/internal/lock"
+)
+
+const (
+	// CA certificates are long lived; leaf certificates follow the 90 day
+	// lifetime common for automated issuance.
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 90 * 24 * time.Hour
+	// RenewBefore is how long before expiry a generated certificate is renewed.
+	RenewBefore = 30 * 24 * time.Hour
+)
+
+// CA is a certificate authority used to sign site certificates.
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+	// PEM is the encoded CA certificate, appended to issued chains.
+	PEM []byte
+}
+
+// errKeyMismatch is returned by loadCA when the stored key does not belong to
+// the stored certificate.
+var errKeyMismatch = errors.New("ca key does not match ca certificate")
+
+// EnsureCA loads the CA stored in dir, creating it on first use and
+// replacing it when it is about to expire. A CA whose key does not match its
+// certificate, e.g. after an interrupted write, cannot sign anything that
+// validates and is replaced as well. Replicas create the CA one at a time, so
+// they all sign with the same one, and a new CA is only written if the lock
+// carried by ctx is still held.
+func EnsureCA(ctx context.Context, dir string) (*CA, error) {
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	if ca, err := currentCA(certFile, keyFile); ca != nil || err != nil {
+		return ca, err
+	}
+
+	lockCtx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+	host, _ := os.Hostname()
+	l, err := lock.Acquire(lockCtx, filepath.Join(dir, "ca.lock"), host, lock.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("acquire ca lock: %w", err)
+	}
+	defer l.Release()
+	// Another replica may have created it while this one was waiting.
+	if ca, err := currentCA(certFile, keyFile); ca != nil || err != nil {
+		return ca, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate ca key: %w", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "multi-wordpress local CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("create ca certificate: %w", err)
+	}
+	certPEM, keyPEM, err := encode(der, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.CheckFence(ctx); err != nil {
+		return nil, fmt.Errorf("ca lock: %w", err)
+	}
+	if err := lock.CheckFence(ctx); err != nil {
+		return nil, err
+	}
+	if err := writePair(certFile, keyFile, certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, Key: key, PEM: certPEM}, nil
+}
+
+// EnsureCertificate makes sure dir holds a certificate for names, issued by ca
+// or self-signed when ca is nil. An existing certificate is kept unless it no
+// longer covers names, was issued by a different CA or is due for renewal.
+// It returns the paths of the certificate chain and key. A new certificate is
+// only written if the lock carried by ctx is still held.
+func EnsureCertificate(ctx context.Context, dir string, names []string, ca *CA) (certFile, keyFile string, err error) {
+	certFile, keyFile = filepath.Join(dir, CertFileName), filepath.Join(dir, KeyFileName)
+	if current(certFile, keyFile, names, ca) {
+		return certFile, keyFile, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("generate key: %w", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	parent, signer := tmpl, crypto.Signer(key)
+	if ca != nil {
+		parent, signer = ca.Cert, ca.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), signer)
+	if err != nil {
+		return "", "", fmt.Errorf("create certificate: %w", err)
+	}
+	certPEM, keyPEM, err := encode(der, key)
+	if err != nil {
+		return "", "", err
+	}
+	if ca != nil {
+		certPEM = append(certPEM, ca.PEM...)
+	}
+	if err := lock.CheckFence(ctx); err != nil {
+		return "", "", err
+	}
+	if err := writePair(certFile, keyFile, certPEM, keyPEM); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// NeedsRenewal reports whether the certificate in certFile is missing, invalid
+// for names or due for renewal.
+func NeedsRenewal(certFile, keyFile string, names []string) bool {
+	if err := Validate(certFile, keyFile, names); err != nil {
+		return true
+	}
+	leaf, err := loadLeaf(certFile)
+	return err != nil || time.Until(leaf.NotAfter) < RenewBefore
+}
+
+// current reports whether the certificate in certFile can be kept as is.
+func current(certFile, keyFile string, names []string, ca *CA) bool {
+	if NeedsRenewal(certFile, keyFile, names) {
+		return false
+	}
+	leaf, err := loadLeaf(certFile)
+	if err != nil {
+		return false
+	}
+	if ca == nil {
+		return bytes.Equal(leaf.RawIssuer, leaf.RawSubject)
+	}
+	return leaf.CheckSignatureFrom(ca.Cert) == nil
+}
+
+// currentCA returns the CA stored in certFile and keyFile, or nil if it has
+// to be created or replaced.
+func currentCA(certFile, keyFile string) (*CA, error) {
+	ca, err := loadCA(certFile, keyFile)
+	if err == nil && time.Until(ca.Cert.NotAfter) > RenewBefore {
+		return ca, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, errKeyMismatch) {
+		return nil, fmt.Errorf("load ca: %w", err)
+	}
+	return nil, nil
+}
+
+func loadCA(certFile, keyFile string) (*CA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cb, _ := pem.Decode(certPEM)
+	kb, _ := pem.Decode(keyPEM)
+	if cb == nil || kb == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+	cert, err := x509.ParseCertificate(cb.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(kb.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, errKeyMismatch
+	}
+	return &CA{Cert: cert, Key: key, PEM: certPEM}, nil
+}
+
+func loadLeaf(certFile string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := pem.Decode(data)
+	if b == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+	return x509.ParseCertificate(b.Bytes)
+}
+
+func encode(der []byte, key *ecdsa.PrivateKey) (certPEM, keyPEM []byte, err error) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal key: %w", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// writePair writes the key before the certificate, each through a temporary
+// file and rename, so readers never see a certificate without its key.
+func writePair(certFile, keyFile string, certPEM, keyPEM []byte) error {
+	if err := os.MkdirAll(filepath.Dir(certFile), 0o700); err != nil {
+		return fmt.Errorf("create cert dir: %w", err)
+	}
+	if err := writeFileAtomic(keyFile, keyPEM, 0o600); err != nil {
+		return fmt.Errorf("write key: %w", err)
+	}
+	if err := writeFileAtomic(certFile, certPEM, 0o644); err != nil {
+		return fmt.Errorf("write certificate: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// over path. Each writer gets its own temporary file, so concurrent writers
+// never interleave.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial: %w", err)
+	}
+	return serial, nil
+}
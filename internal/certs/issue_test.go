@@ -0,0 +1,235 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eryalito/multi-wordpress-file-manager/internal/lock"
+)
+
+// readLeaf returns the leaf certificate of the chain in certFile and the
+// number of certificates in it.
+func readLeaf(t *testing.T, certFile string) (*x509.Certificate, int) {
+	t.Helper()
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var b *pem.Block
+		if b, data = pem.Decode(data); b == nil {
+			break
+		}
+		c, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		t.Fatalf("no certificate in %s", certFile)
+	}
+	return certs[0], len(certs)
+}
+
+func TestEnsureCertificateSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"example.com", "www.example.com"}
+	certFile, keyFile, err := EnsureCertificate(context.Background(), dir, names, nil)
+	if err != nil {
+		t.Fatalf("EnsureCertificate: %v", err)
+	}
+	if err := Validate(certFile, keyFile, names); err != nil {
+		t.Fatalf("issued certificate invalid: %v", err)
+	}
+	leaf, n := readLeaf(t, certFile)
+	if n != 1 || !bytes.Equal(leaf.RawIssuer, leaf.RawSubject) {
+		t.Errorf("certificate not self-signed: %d certificate(s), issuer %s", n, leaf.Issuer)
+	}
+
+	if _, _, err := EnsureCertificate(context.Background(), dir, names, nil); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := readLeaf(t, certFile); again.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Error("current certificate reissued")
+	}
+
+	names = append(names, "blog.example.com")
+	if _, _, err := EnsureCertificate(context.Background(), dir, names, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(certFile, keyFile, names); err != nil {
+		t.Errorf("certificate not reissued for a new name: %v", err)
+	}
+}
+
+func TestEnsureCertificateWithoutLock(t *testing.T) {
+	dir := t.TempDir()
+	// A replica that lost its lock while the certificate was generated.
+	ctx := lock.WithLeader(context.Background(), &lock.Leader{})
+	if _, _, err := EnsureCertificate(ctx, dir, []string{"example.com"}, nil); !errors.Is(err, lock.ErrStaleFence) {
+		t.Fatalf("EnsureCertificate = %v, want a stale fence", err)
+	}
+	if _, err := EnsureCA(ctx, filepath.Join(dir, "ca")); !errors.Is(err, lock.ErrStaleFence) {
+		t.Fatalf("EnsureCA = %v, want a stale fence", err)
+	}
+	for _, f := range []string{CertFileName, KeyFileName, "ca/ca.crt", "ca/ca.key"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); !os.IsNotExist(err) {
+			t.Errorf("%s written without the lock: %v", f, err)
+		}
+	}
+}
+
+func TestEnsureCertificateFromCA(t *testing.T) {
+	ca, err := EnsureCA(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(ca.Cert.NotAfter) < RenewBefore || !ca.Cert.IsCA {
+		t.Fatalf("CA not usable: valid until %s, IsCA %v", ca.Cert.NotAfter, ca.Cert.IsCA)
+	}
+
+	dir := t.TempDir()
+	names := []string{"example.com"}
+	certFile, keyFile, err := EnsureCertificate(context.Background(), dir, names, ca)
+	if err != nil {
+		t.Fatalf("EnsureCertificate: %v", err)
+	}
+	if err := Validate(certFile, keyFile, names); err != nil {
+		t.Fatalf("issued certificate invalid: %v", err)
+	}
+	leaf, n := readLeaf(t, certFile)
+	if n != 2 {
+		t.Errorf("chain has %d certificate(s), want the leaf and the CA", n)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "example.com"}); err != nil {
+		t.Errorf("certificate does not verify against the CA: %v", err)
+	}
+
+	other, err := EnsureCA(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := EnsureCertificate(context.Background(), dir, names, other); err != nil {
+		t.Fatal(err)
+	}
+	if leaf, _ := readLeaf(t, certFile); leaf.CheckSignatureFrom(other.Cert) != nil {
+		t.Error("certificate not reissued by the new CA")
+	}
+}
+
+func TestEnsureCAReusesCurrent(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := EnsureCA(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := EnsureCA(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.PEM, ca.PEM) {
+		t.Error("current CA replaced")
+	}
+}
+
+func TestObtainKeepsCurrentCertificate(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"example.com"}
+	if _, _, err := EnsureCertificate(context.Background(), dir, names, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The CA is unreachable, so contacting it fails the test.
+	i := &ACMEIssuer{DirectoryURL: "http://127.0.0.1:0/dir", StateDir: t.TempDir(), Member: "test"}
+	certFile, keyFile, err := i.Obtain(context.Background(), dir, names)
+	if err != nil {
+		t.Fatalf("Obtain: %v", err)
+	}
+	if certFile != filepath.Join(dir, CertFileName) || keyFile != filepath.Join(dir, KeyFileName) {
+		t.Errorf("Obtain = %s, %s", certFile, keyFile)
+	}
+}
+
+func TestAccountKeyIsShared(t *testing.T) {
+	state := t.TempDir()
+	a, err := (&ACMEIssuer{StateDir: state}).accountKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := (&ACMEIssuer{StateDir: state}).accountKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Equal(b) {
+		t.Error("second issuer generated another account key")
+	}
+}
+
+func TestEnsureCAReplacesMismatchedKey(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := EnsureCA(context.Background(), dir); err != nil {
+		t.Fatal(err)
+	}
+	// A key written by an interrupted replacement of the CA.
+	other := t.TempDir()
+	if _, err := EnsureCA(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile(filepath.Join(other, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ca.key"), key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := EnsureCA(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("EnsureCA: %v", err)
+	}
+	if bytes.Equal(ca.PEM, stale) {
+		t.Error("mismatched CA kept")
+	}
+	if _, err := loadCA(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")); err != nil {
+		t.Errorf("replaced CA: %v", err)
+	}
+}
+
+func TestEnsureCAConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	cas := make(chan *CA, 4)
+	errs := make(chan error, 4)
+	for range 4 {
+		go func() {
+			ca, err := EnsureCA(context.Background(), dir)
+			cas <- ca
+			errs <- err
+		}()
+	}
+	var first *CA
+	for range 4 {
+		ca := <-cas
+		if err := <-errs; err != nil {
+			t.Fatalf("EnsureCA: %v", err)
+		}
+		if first == nil {
+			first = ca
+		} else if !first.Cert.Equal(ca.Cert) {
+			t.Fatal("replicas created different CAs")
+		}
+	}
+}
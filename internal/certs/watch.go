@@ -0,0 +1,52 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch watches the given directories and invokes onChange whenever anything
+// inside them changes, e.g. when a mounted secret is updated with a renewed
+// certificate. Rapid sequences of events are debounced into a single call.
+// Watching stops when ctx is canceled or the returned stop function is called.
+func Watch(ctx context.Context, dirs []string, onChange func()) (func() error, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("create watcher: %w", err)
+	}
+	for _, dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			_ = w.Close()
+			return nil, fmt.Errorf("watch dir %s: %w", dir, err)
+		}
+	}
+
+	const debounce = 500 * time.Millisecond
+	go func() {
+		defer w.Close()
+		var timerC <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				timerC = time.After(debounce)
+			case _, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+			case <-timerC:
+				timerC = nil
+				onChange()
+			}
+		}
+	}()
+
+	return w.Close, nil
+}
@@ -18,6 +18,22 @@ import (
 
 // Load reads and parses the YAML configuration file at path.
 func Load(path string) (*config.Config, error) {
+	cfg, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadRedirectFiles(cfg, filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("load redirects: %w", err)
+	}
+	if err := Validate(cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// read reads and parses the YAML configuration file at path, without the
+// files it refers to.
+func read(path string) (*config.Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
@@ -35,7 +51,9 @@ func Load(path string) (*config.Config, error) {
 // Watch watches the directory containing path and invokes onChange whenever the
 // target file is changed. It debounces rapid sequences of events and reloads the
 // config before invoking the callback. The callback receives either the new
-// config or an error if reload failed.
+// config or an error if reload failed. The redirects files the config refers
+// to are watched too, as are the ..data symlinks Kubernetes swaps to update
+// the files of a mounted Secret or ConfigMap.
 func Watch(ctx context.Context, path string, onChange func(*config.Config, error)) (func() error, error) {
 	abs, err := filepath.Abs(path)
 	if err != nil {
@@ -53,6 +71,27 @@ func Watch(ctx context.Context, path string, onChange func(*config.Config, error
 		_ = w.Close()
 		return nil, fmt.Errorf("watch dir %s: %w", dir, err)
 	}
+	watched := map[string]bool{abs: true}
+	dirs := map[string]bool{dir: true}
+	// watchRedirects adds the redirects files of cfg to the watched files.
+	// Files no longer referred to stay watched, which only costs a reload.
+	watchRedirects := func(cfg *config.Config) {
+		for _, p := range redirectFiles(cfg, dir) {
+			if !dirs[filepath.Dir(p)] {
+				if err := w.Add(filepath.Dir(p)); err != nil {
+					if onChange != nil {
+						onChange(nil, fmt.Errorf("watch dir %s: %w", filepath.Dir(p), err))
+					}
+					continue
+				}
+				dirs[filepath.Dir(p)] = true
+			}
+			watched[p] = true
+		}
+	}
+	if cfg, err := read(abs); err == nil {
+		watchRedirects(cfg)
+	}
 
 	// Debounce timer; zero value means inactive.
 	const debounce = 200 * time.Millisecond
@@ -84,8 +123,8 @@ func Watch(ctx context.Context, path string, onChange func(*config.Config, error
 				if ev.Name == "" {
 					continue
 				}
-				// Only react to events for our file
-				if !sameFile(ev.Name, abs) {
+				// Only react to events for our files
+				if !watchedFile(ev.Name, watched) && !(filepath.Base(ev.Name) == "..data" && dirs[filepath.Dir(ev.Name)]) {
 					continue
 				}
 				// Interested in writes, creates, renames, removes, chmods
@@ -100,6 +139,9 @@ func Watch(ctx context.Context, path string, onChange func(*config.Config, error
 			case <-timerC:
 				// Debounced reload
 				cfg, err := Load(abs)
+				if cfg != nil {
+					watchRedirects(cfg)
+				}
 				if onChange != nil {
 					onChange(cfg, err)
 				}
@@ -114,6 +156,16 @@ func Watch(ctx context.Context, path string, onChange func(*config.Config, error
 	return stop, nil
 }
 
+// watchedFile reports whether name is one of the watched files.
+func watchedFile(name string, watched map[string]bool) bool {
+	for p := range watched {
+		if sameFile(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
 func sameFile(a, b string) bool {
 	if a == b {
 		return true
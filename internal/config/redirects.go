@@ -0,0 +1,240 @@
+package config
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	config "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// maxRedirectHops bounds how far redirect chains are followed when looking
+// for loops.
+const maxRedirectHops = 20
+
+// loadRedirectFiles appends the redirects read from each site's
+// redirects_file to its inline redirects. Relative paths are resolved
+// against dir, the directory of the configuration file.
+func loadRedirectFiles(cfg *config.Config, dir string) error {
+	for i := range cfg.Sites {
+		site := &cfg.Sites[i]
+		if site.RedirectsFile == "" {
+			continue
+		}
+		redirects, err := readRedirectsCSV(redirectsPath(*site, dir))
+		if err != nil {
+			return fmt.Errorf("site %s: redirects_file: %w", site.DomainName, err)
+		}
+		site.Redirects = append(site.Redirects, redirects...)
+	}
+	return nil
+}
+
+// readRedirectsCSV reads exact-path redirects from a CSV file with the
+// columns source,target and an optional status. Empty lines and lines
+// starting with # are ignored.
+func readRedirectsCSV(path string) ([]config.Redirect, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	var redirects []config.Redirect
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return redirects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := r.FieldPos(0)
+		if len(rec) < 2 || len(rec) > 3 {
+			return nil, fmt.Errorf("line %d: expected source,target[,status]", line)
+		}
+		rd := config.Redirect{Source: strings.TrimSpace(rec[0]), Target: strings.TrimSpace(rec[1])}
+		if len(rec) == 3 && strings.TrimSpace(rec[2]) != "" {
+			if rd.Status, err = strconv.Atoi(strings.TrimSpace(rec[2])); err != nil {
+				return nil, fmt.Errorf("line %d: invalid status %q", line, rec[2])
+			}
+		}
+		redirects = append(redirects, rd)
+	}
+}
+
+// redirectRule is a redirect as Apache matches it: exact sources are
+// anchored and quoted, as they are rendered.
+type redirectRule struct {
+	source *regexp.Regexp
+	target string
+}
+
+// validateRedirects checks every redirect of a site and that following the
+// redirects never leads back to an already visited path.
+func validateRedirects(site config.Site) error {
+	var errs []error
+	exact := map[string]bool{}
+	var rules []redirectRule
+	for i, rd := range site.Redirects {
+		switch rd.Status {
+		case 0, 301, 302, 303, 307, 308:
+		default:
+			errs = append(errs, fmt.Errorf("redirects[%d]: unsupported status %d", i, rd.Status))
+		}
+		if rd.Target == "" || strings.ContainsAny(rd.Target, " \t\n\"") {
+			errs = append(errs, fmt.Errorf("redirects[%d]: target %q must be non-empty and contain no spaces or quotes", i, rd.Target))
+			continue
+		}
+		if rd.Regex {
+			re, err := regexp.Compile(rd.Source)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("redirects[%d]: invalid regex %q: %w", i, rd.Source, err))
+				continue
+			}
+			if err := portableRegex(rd.Source); err != nil {
+				errs = append(errs, fmt.Errorf("redirects[%d]: regex %q: %w", i, rd.Source, err))
+				continue
+			}
+			if strings.ContainsAny(rd.Source, " \t\n\"") {
+				errs = append(errs, fmt.Errorf("redirects[%d]: regex %q must not contain spaces or quotes", i, rd.Source))
+				continue
+			}
+			rules = append(rules, redirectRule{re, rd.Target})
+			continue
+		}
+		if !strings.HasPrefix(rd.Source, "/") || strings.ContainsAny(rd.Source, " \t\n\"") {
+			errs = append(errs, fmt.Errorf("redirects[%d]: source %q must be a path starting with / without spaces or quotes", i, rd.Source))
+			continue
+		}
+		if exact[rd.Source] {
+			errs = append(errs, fmt.Errorf("redirects[%d]: duplicate source %s", i, rd.Source))
+			continue
+		}
+		exact[rd.Source] = true
+		rules = append(rules, redirectRule{regexp.MustCompile("^" + regexp.QuoteMeta(rd.Source) + "$"), rd.Target})
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// next returns where a request for path is redirected to on this site:
+	// the first rule matching it applies, in the order they are rendered.
+	next := func(path string) (string, bool) {
+		for _, r := range rules {
+			if m := r.source.FindStringSubmatchIndex(path); m != nil {
+				return localPath(site, string(r.source.ExpandString(nil, r.target, path, m)))
+			}
+		}
+		return "", false
+	}
+	for _, rd := range site.Redirects {
+		start := rd.Source
+		if rd.Regex {
+			// Only a literal target can be followed without a concrete
+			// request; the chain starts at the path it redirects to.
+			if strings.Contains(rd.Target, "$") {
+				continue
+			}
+			p, ok := localPath(site, rd.Target)
+			if !ok {
+				continue
+			}
+			start = p
+		}
+		seen := map[string]bool{start: true}
+		chain := []string{start}
+		if rd.Regex {
+			chain = []string{rd.Source, start}
+		}
+		for p, ok := next(start); ok; p, ok = next(p) {
+			chain = append(chain, p)
+			if seen[p] {
+				return fmt.Errorf("redirect loop: %s", strings.Join(chain, " -> "))
+			}
+			if len(chain) > maxRedirectHops {
+				return fmt.Errorf("redirect chain too long: %s", strings.Join(chain, " -> "))
+			}
+			seen[p] = true
+		}
+	}
+	return nil
+}
+
+// portableRegex checks that a regex accepted by Go's RE2, which validates
+// the redirects here, means the same to the PCRE engine Apache runs it with.
+// Constructs only PCRE supports, such as lookarounds and backreferences, are
+// already rejected by RE2. Non-ASCII characters are rejected because RE2
+// matches them as runes and PCRE as bytes, as are \p and \P classes, which
+// depend on that too, and \v and \C, whose meanings differ.
+func portableRegex(src string) error {
+	for i := 0; i < len(src); i++ {
+		if src[i] >= 0x80 {
+			return errors.New("non-ASCII characters are not supported")
+		}
+		if src[i] != '\\' || i+1 == len(src) {
+			continue
+		}
+		i++
+		switch src[i] {
+		case 'p', 'P', 'v', 'C':
+			return fmt.Errorf(`\%c is not supported: it differs between Go and Apache's PCRE`, src[i])
+		}
+	}
+	return nil
+}
+
+// redirectFiles returns the redirects files of cfg's sites, with relative
+// paths resolved against dir, the directory of the configuration file.
+func redirectFiles(cfg *config.Config, dir string) []string {
+	var paths []string
+	for _, site := range cfg.Sites {
+		if site.RedirectsFile != "" {
+			paths = append(paths, redirectsPath(site, dir))
+		}
+	}
+	return paths
+}
+
+func redirectsPath(site config.Site, dir string) string {
+	if filepath.IsAbs(site.RedirectsFile) {
+		return site.RedirectsFile
+	}
+	return filepath.Join(dir, site.RedirectsFile)
+}
+
+// localPath returns the path of target when it points back at site, either as
+// a relative path or as an absolute URL to one of the site's hostnames.
+func localPath(site config.Site, target string) (string, bool) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false
+	}
+	if u.Host != "" {
+		local := false
+		for _, name := range site.Hostnames() {
+			if strings.EqualFold(u.Hostname(), name) {
+				local = true
+				break
+			}
+		}
+		if !local {
+			return "", false
+		}
+	}
+	if u.Path == "" {
+		return "/", true
+	}
+	return u.Path, strings.HasPrefix(u.Path, "/")
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	config "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+func TestValidateRedirectsFollowsRenderedOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		redirects []config.Redirect
+		wantLoop  bool
+	}{
+		{
+			name: "regex first breaks the exact cycle",
+			redirects: []config.Redirect{
+				{Source: "^/b$", Target: "/c", Regex: true},
+				{Source: "/a", Target: "/b"},
+				{Source: "/b", Target: "/a"},
+			},
+		},
+		{
+			name: "regex first closes a cycle",
+			redirects: []config.Redirect{
+				{Source: "^/a$", Target: "/c", Regex: true},
+				{Source: "/c", Target: "/a"},
+				{Source: "/a", Target: "/d"},
+			},
+			wantLoop: true,
+		},
+		{
+			name: "exact cycle",
+			redirects: []config.Redirect{
+				{Source: "/a", Target: "/b"},
+				{Source: "/b", Target: "https://example.com/a"},
+			},
+			wantLoop: true,
+		},
+		{
+			name: "regex matching its own target",
+			redirects: []config.Redirect{
+				{Source: "^/old", Target: "/old-page", Regex: true},
+			},
+			wantLoop: true,
+		},
+		{
+			name: "external target",
+			redirects: []config.Redirect{
+				{Source: "/a", Target: "https://other.example.org/a"},
+				{Source: "^/(.*)$", Target: "/a", Regex: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRedirects(config.Site{DomainName: "example.com", Redirects: tt.redirects})
+			if gotLoop := err != nil && strings.Contains(err.Error(), "loop"); gotLoop != tt.wantLoop || (err != nil && !gotLoop) {
+				t.Errorf("validateRedirects = %v, want loop %v", err, tt.wantLoop)
+			}
+		})
+	}
+}
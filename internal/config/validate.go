@@ -0,0 +1,454 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	config "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// Validate checks the configuration for errors that would otherwise only
+// surface while reconciling. All problems found are returned joined.
+func Validate(cfg *config.Config) error {
+	var errs []error
+	if err := validateSecurityHeaders(&cfg.Proxy.SecurityHeaders); err != nil {
+		errs = append(errs, fmt.Errorf("proxy: security_headers: %w", err))
+	}
+	if err := validateLogging(&cfg.Proxy.Logging); err != nil {
+		errs = append(errs, fmt.Errorf("proxy: logging: %w", err))
+	}
+	if err := validateDefaultSite(cfg); err != nil {
+		errs = append(errs, fmt.Errorf("proxy: default_site: %w", err))
+	}
+	if err := validateTraefik(cfg.Proxy.Traefik); err != nil {
+		errs = append(errs, fmt.Errorf("proxy: traefik: %w", err))
+	}
+	for i, site := range cfg.Sites {
+		if site.DomainName == "" {
+			errs = append(errs, fmt.Errorf("sites[%d]: domain_name is required", i))
+			continue
+		}
+		name := site.DomainName + site.PathPrefix
+		if err := validatePathPrefix(site.PathPrefix); err != nil {
+			errs = append(errs, fmt.Errorf("site %s: path_prefix: %w", name, err))
+		}
+		if err := validateTLS(site); err != nil {
+			errs = append(errs, fmt.Errorf("site %s: tls: %w", name, err))
+		}
+		if m := site.Maintenance; m != nil {
+			if err := validateIPs(m.AllowIPs); err != nil {
+				errs = append(errs, fmt.Errorf("site %s: maintenance: allow_ips: %w", name, err))
+			}
+			if m.RetryAfter < 0 {
+				errs = append(errs, fmt.Errorf("site %s: maintenance: retry_after must not be negative", name))
+			}
+		}
+		if err := validateAccess(site.Access); err != nil {
+			errs = append(errs, fmt.Errorf("site %s: access: %w", name, err))
+		}
+		if err := validateRedirects(site); err != nil {
+			errs = append(errs, fmt.Errorf("site %s: redirects: %w", name, err))
+		}
+		if err := validateSecurityHeaders(site.SecurityHeaders); err != nil {
+			errs = append(errs, fmt.Errorf("site %s: security_headers: %w", name, err))
+		}
+		if err := validateFPMPool(site.FPM, cfg.Proxy.FPM.RootMaster); err != nil {
+			errs = append(errs, fmt.Errorf("site %s: fpm: %w", name, err))
+		}
+		if err := validatePHP(site.PHP); err != nil {
+			errs = append(errs, fmt.Errorf("site %s: php: %w", name, err))
+		}
+		if err := validateLogging(site.Logging); err != nil {
+			errs = append(errs, fmt.Errorf("site %s: logging: %w", name, err))
+		}
+		if err := validateCache(site.Cache); err != nil {
+			errs = append(errs, fmt.Errorf("site %s: cache: %w", name, err))
+		}
+		if err := validateNetwork(site); err != nil {
+			errs = append(errs, fmt.Errorf("site %s: network: %w", name, err))
+		}
+	}
+	errs = append(errs, validateSiteGroups(cfg.Sites)...)
+	return errors.Join(errs...)
+}
+
+// pathPrefixPattern matches a path of one or more segments without a trailing
+// slash. Segments may not start with a dot.
+var pathPrefixPattern = regexp.MustCompile(`^(/[A-Za-z0-9_~-][A-Za-z0-9._~-]*)+$`)
+
+func validatePathPrefix(prefix string) error {
+	if prefix != "" && !pathPrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("%q must be a path such as /blog, without a trailing slash", prefix)
+	}
+	return nil
+}
+
+// validateSiteGroups checks sites sharing a domain: their path prefixes must
+// not overlap, and only the domain's primary site may carry the settings that
+// apply to the whole vhost.
+func validateSiteGroups(sites []config.Site) []error {
+	var errs []error
+	ids := map[string]string{}
+	for _, site := range sites {
+		name := site.DomainName + site.PathPrefix
+		if other, ok := ids[site.ID()]; ok && other != name {
+			errs = append(errs, fmt.Errorf("site %s: path_prefix: conflicts with %s", name, other))
+		}
+		ids[site.ID()] = name
+	}
+	for _, group := range config.GroupByDomain(sites) {
+		for i, a := range group {
+			for _, b := range group[:i] {
+				if prefixesOverlap(a.PathPrefix, b.PathPrefix) {
+					errs = append(errs, fmt.Errorf("site %s%s: path_prefix: overlaps with %s%s", a.DomainName, a.PathPrefix, b.DomainName, b.PathPrefix))
+				}
+			}
+			if i == 0 {
+				continue
+			}
+			if fields := vhostSettings(a); len(fields) > 0 {
+				errs = append(errs, fmt.Errorf("site %s%s: %s must be set on %s%s, whose vhost serves the domain",
+					a.DomainName, a.PathPrefix, strings.Join(fields, ", "), group[0].DomainName, group[0].PathPrefix))
+			}
+		}
+	}
+	return errs
+}
+
+// prefixesOverlap reports whether two sites of a domain would compete for the
+// same requests. A site at the root only overlaps another one at the root.
+func prefixesOverlap(a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// vhostSettings returns the vhost-wide settings set on a site.
+func vhostSettings(site config.Site) []string {
+	var fields []string
+	for name, set := range map[string]bool{
+		"aliases":          len(site.Aliases) > 0,
+		"tls":              site.TLS != nil,
+		"maintenance":      site.Maintenance != nil,
+		"redirects":        len(site.Redirects) > 0 || site.RedirectsFile != "",
+		"security_headers": site.SecurityHeaders != nil,
+		"hardening":        site.Hardening != nil,
+		"logging":          site.Logging != nil,
+		"cache":            site.Cache != nil,
+	} {
+		if set {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func validateAccess(a *config.Access) error {
+	if a == nil {
+		return nil
+	}
+	var errs []error
+	seen := map[string]bool{}
+	for i, u := range a.Users {
+		switch {
+		case u.Username == "":
+			errs = append(errs, fmt.Errorf("users[%d]: username is required", i))
+		case strings.Contains(u.Username, ":"):
+			errs = append(errs, fmt.Errorf("users[%d]: username must not contain ':'", i))
+		case seen[u.Username]:
+			errs = append(errs, fmt.Errorf("users[%d]: duplicate username %s", i, u.Username))
+		}
+		seen[u.Username] = true
+		if (u.Password == "") == (u.PasswordHash == "") {
+			errs = append(errs, fmt.Errorf("users[%d]: exactly one of password or password_hash is required", i))
+		}
+		if u.PasswordHash != "" {
+			if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+				errs = append(errs, fmt.Errorf("users[%d]: password_hash is not a bcrypt hash", i))
+			}
+		}
+	}
+	if err := validateIPs(a.Allow); err != nil {
+		errs = append(errs, fmt.Errorf("allow: %w", err))
+	}
+	if err := validateIPs(a.Deny); err != nil {
+		errs = append(errs, fmt.Errorf("deny: %w", err))
+	}
+	for _, p := range a.ExemptPaths {
+		if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "\" \t") {
+			errs = append(errs, fmt.Errorf("exempt_paths: %q must start with / and contain no quotes or spaces", p))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateTLS(site config.Site) error {
+	t := site.TLS
+	if t == nil {
+		return nil
+	}
+	switch t.Mode {
+	case "", config.TLSModeFiles:
+	case config.TLSModeACME:
+		for _, name := range site.Hostnames() {
+			if strings.HasPrefix(name, "*.") {
+				return fmt.Errorf("wildcard name %s cannot be validated over HTTP-01", name)
+			}
+		}
+		fallthrough
+	case config.TLSModeSelfSigned, config.TLSModeLocalCA:
+		if t.CertFile != "" || t.KeyFile != "" || t.Dir != "" {
+			return fmt.Errorf("cert_file, key_file and dir cannot be set in %s mode", t.Mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q", t.Mode)
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	if t.CertFile == "" && t.Dir == "" {
+		return errors.New("cert_file and key_file, or dir, is required")
+	}
+	if t.CertFile != "" && t.Dir != "" {
+		return errors.New("cert_file/key_file and dir are mutually exclusive")
+	}
+	return nil
+}
+
+// sizePattern matches PHP shorthand byte values such as 512K, 64M or 1G.
+var sizePattern = regexp.MustCompile(`^[0-9]+[KMGkmg]?$`)
+
+// validateFPMPool checks the pool settings of a site. rootMaster reports
+// whether the PHP-FPM master runs as root; otherwise it ignores the pool's
+// user and group, so only www-data is accepted.
+func validateFPMPool(p *config.FPMPool, rootMaster bool) error {
+	if p == nil {
+		return nil
+	}
+	var errs []error
+	if !rootMaster {
+		for name, v := range map[string]string{"user": p.User, "group": p.Group} {
+			if v != "" && v != "www-data" {
+				errs = append(errs, fmt.Errorf("%s: %q needs proxy.fpm.root_master: PHP-FPM only switches pools to another user when its master runs as root", name, v))
+			}
+		}
+	}
+	switch p.PM {
+	case "", "dynamic", "static", "ondemand":
+	default:
+		errs = append(errs, fmt.Errorf("pm: %q must be dynamic, static or ondemand", p.PM))
+	}
+	for name, v := range map[string]int{
+		"max_children":      p.MaxChildren,
+		"start_servers":     p.StartServers,
+		"min_spare_servers": p.MinSpareServers,
+		"max_spare_servers": p.MaxSpareServers,
+		"max_requests":      p.MaxRequests,
+	} {
+		if v < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", name))
+		}
+	}
+	if p.MinSpareServers > 0 && p.MaxSpareServers > 0 && p.MinSpareServers > p.MaxSpareServers {
+		errs = append(errs, errors.New("min_spare_servers must not exceed max_spare_servers"))
+	}
+	for name, v := range map[string]string{
+		"upload_max_filesize": p.UploadMaxFilesize,
+		"memory_limit":        p.MemoryLimit,
+	} {
+		if v != "" && !sizePattern.MatchString(v) {
+			errs = append(errs, fmt.Errorf("%s: %q is not a size such as 64M", name, v))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// integerPattern matches a non-negative number of seconds or items.
+var integerPattern = regexp.MustCompile(`^[0-9]+$`)
+
+// phpSettings lists the php.ini settings a site may override, with the
+// pattern their values must match.
+var phpSettings = map[string]*regexp.Regexp{
+	"upload_max_filesize": sizePattern,
+	"post_max_size":       sizePattern,
+	"memory_limit":        regexp.MustCompile(`^(-1|[0-9]+[KMGkmg]?)$`),
+	"max_execution_time":  integerPattern,
+	"max_input_time":      regexp.MustCompile(`^(-1|[0-9]+)$`),
+	"max_input_vars":      integerPattern,
+}
+
+func validatePHP(settings map[string]string) error {
+	var errs []error
+	for key, value := range settings {
+		pattern, ok := phpSettings[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unsupported setting %q", key))
+			continue
+		}
+		if !pattern.MatchString(value) {
+			errs = append(errs, fmt.Errorf("%s: invalid value %q", key, value))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateLogging(l *config.Logging) error {
+	if l == nil {
+		return nil
+	}
+	var errs []error
+	switch l.Target {
+	case "", config.LogTargetFile, config.LogTargetStdout, config.LogTargetStderr, config.LogTargetRotatelogs:
+	default:
+		errs = append(errs, fmt.Errorf("target: unknown target %q", l.Target))
+	}
+	switch l.Format {
+	case "", config.LogFormatCombined, config.LogFormatJSON:
+	default:
+		errs = append(errs, fmt.Errorf("format: unknown format %q", l.Format))
+	}
+	if strings.ContainsAny(l.Dir, " \t\n\"") {
+		errs = append(errs, errors.New("dir: must not contain spaces or quotes"))
+	}
+	if l.Rotation != "" && !sizePattern.MatchString(l.Rotation) {
+		errs = append(errs, fmt.Errorf("rotation: %q must be seconds or a size such as 100M", l.Rotation))
+	}
+	return errors.Join(errs...)
+}
+
+func validateDefaultSite(cfg *config.Config) error {
+	d := cfg.Proxy.DefaultSite
+	if d == nil {
+		return nil
+	}
+	action, arg := d.Action()
+	switch action {
+	case config.DefaultSiteDeny:
+		if arg != "" {
+			return fmt.Errorf("mode %q takes no argument", action)
+		}
+	case config.DefaultSiteRedirect:
+		u, err := url.Parse(arg)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(arg, " \t\n\"") {
+			return fmt.Errorf("redirect target %q must be an absolute http(s) URL", arg)
+		}
+	case config.DefaultSiteServe:
+		for _, site := range cfg.Sites {
+			if site.DomainName == arg {
+				return nil
+			}
+		}
+		return fmt.Errorf("serve target %q is not a configured site", arg)
+	default:
+		return fmt.Errorf("unknown mode %q", d.Mode)
+	}
+	return nil
+}
+
+// cookiePattern matches the cookie name prefixes a cache may be bypassed on.
+var cookiePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func validateCache(c *config.Cache) error {
+	if c == nil {
+		return nil
+	}
+	var errs []error
+	if c.TTL < 0 {
+		errs = append(errs, errors.New("ttl must not be negative"))
+	}
+	for _, p := range c.BypassPaths {
+		if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "\" \t\n") {
+			errs = append(errs, fmt.Errorf("bypass_paths: %q must start with / and contain no quotes or spaces", p))
+		}
+	}
+	for _, name := range c.BypassCookies {
+		if !cookiePattern.MatchString(name) {
+			errs = append(errs, fmt.Errorf("bypass_cookies: %q may only contain letters, digits, '_' and '-'", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateNetwork(site config.Site) error {
+	n := site.Network
+	if n == nil {
+		return nil
+	}
+	var errs []error
+	switch n.Mode {
+	case config.NetworkModeSubdomain, config.NetworkModeSubdirectory:
+	default:
+		errs = append(errs, fmt.Errorf("mode: %q must be subdomain or subdirectory", n.Mode))
+	}
+	if site.PathPrefix != "" {
+		errs = append(errs, errors.New("cannot be combined with path_prefix"))
+	}
+	for _, name := range n.Sites {
+		if name == "" || name == site.DomainName || strings.ContainsAny(name, " \t\n\"/") {
+			errs = append(errs, fmt.Errorf("sites: %q is not a valid hostname", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateTraefik(t *config.Traefik) error {
+	if t == nil {
+		return nil
+	}
+	var errs []error
+	if t.File == "" {
+		errs = append(errs, errors.New("file is required"))
+	}
+	if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("url: %q must be an absolute http(s) URL", t.URL))
+	}
+	return errors.Join(errs...)
+}
+
+// validateIPs checks that every entry is an IP address or a CIDR range.
+func validateIPs(ips []string) error {
+	for _, ip := range ips {
+		if net.ParseIP(ip) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(ip); err != nil {
+			return fmt.Errorf("%q is not an IP address or CIDR", ip)
+		}
+	}
+	return nil
+}
+
+func validateSecurityHeaders(h *config.SecurityHeaders) error {
+	if h == nil {
+		return nil
+	}
+	var errs []error
+	if h.HSTS != nil && h.HSTS.MaxAge < 0 {
+		errs = append(errs, errors.New("hsts: max_age must not be negative"))
+	}
+	switch strings.ToUpper(h.FrameOptions) {
+	case "", "DENY", "SAMEORIGIN":
+	default:
+		errs = append(errs, fmt.Errorf("frame_options: %q must be DENY or SAMEORIGIN", h.FrameOptions))
+	}
+	for name, v := range map[string]string{
+		"content_security_policy": h.ContentSecurityPolicy,
+		"referrer_policy":         h.ReferrerPolicy,
+		"permissions_policy":      h.PermissionsPolicy,
+	} {
+		if strings.ContainsAny(v, "\r\n") {
+			errs = append(errs, fmt.Errorf("%s: must be a single line", name))
+		}
+	}
+	return errors.Join(errs...)
+}
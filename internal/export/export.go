@@ -0,0 +1,68 @@
+// Package export renders routing manifests for the sites of a configuration,
+// so the ingress layer in front of the proxy can be kept in sync with it.
+package export
+
+import (
+	"strings"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// Options describes the objects to generate and the backend they route to.
+type Options struct {
+	// Name and Namespace of the generated objects.
+	Name      string
+	Namespace string
+	// Service and Port are the backend every host is routed to.
+	Service string
+	Port    int
+	// IngressClass is the class of generated Ingresses, if set.
+	IngressClass string
+	// TLS adds a TLS entry per domain to generated Ingresses. The secret is
+	// TLSSecret if set, or named after the domain, e.g. example-com-tls.
+	TLS       bool
+	TLSSecret string
+	// Gateway and GatewayNamespace are the parent of generated HTTPRoutes.
+	Gateway          string
+	GatewayNamespace string
+}
+
+// domain is a domain served by the proxy with the names it answers to.
+type domain struct {
+	Name      string
+	Hostnames []string
+}
+
+// domains returns the domains of the configured sites, in order, with their
+// aliases and network names. Names already routed for an earlier domain are
+// left out.
+func domains(c *cfg.Config) []domain {
+	var out []domain
+	seen := map[string]bool{}
+	for _, group := range cfg.GroupByDomain(c.Sites) {
+		d := domain{Name: group[0].DomainName}
+		for _, name := range group[0].Hostnames() {
+			if !seen[name] {
+				seen[name] = true
+				d.Hostnames = append(d.Hostnames, name)
+			}
+		}
+		if len(d.Hostnames) > 0 {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// secretName returns the TLS secret of a domain.
+func (o Options) secretName(d domain) string {
+	if o.TLSSecret != "" {
+		return o.TLSSecret
+	}
+	return slug(d.Name) + "-tls"
+}
+
+// slug turns a domain name into a valid Kubernetes object name.
+func slug(name string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(name, "*."), ".", "-")
+}
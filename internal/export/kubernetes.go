@@ -0,0 +1,157 @@
+package export
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+type objectMeta struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+type ingress struct {
+	APIVersion string      `yaml:"apiVersion"`
+	Kind       string      `yaml:"kind"`
+	Metadata   objectMeta  `yaml:"metadata"`
+	Spec       ingressSpec `yaml:"spec"`
+}
+
+type ingressSpec struct {
+	IngressClassName string        `yaml:"ingressClassName,omitempty"`
+	TLS              []ingressTLS  `yaml:"tls,omitempty"`
+	Rules            []ingressRule `yaml:"rules"`
+}
+
+type ingressTLS struct {
+	Hosts      []string `yaml:"hosts"`
+	SecretName string   `yaml:"secretName"`
+}
+
+type ingressRule struct {
+	Host string           `yaml:"host"`
+	HTTP ingressRuleValue `yaml:"http"`
+}
+
+type ingressRuleValue struct {
+	Paths []ingressPath `yaml:"paths"`
+}
+
+type ingressPath struct {
+	Path     string         `yaml:"path"`
+	PathType string         `yaml:"pathType"`
+	Backend  ingressBackend `yaml:"backend"`
+}
+
+type ingressBackend struct {
+	Service serviceBackend `yaml:"service"`
+}
+
+type serviceBackend struct {
+	Name string      `yaml:"name"`
+	Port servicePort `yaml:"port"`
+}
+
+type servicePort struct {
+	Number int `yaml:"number"`
+}
+
+// Ingress renders a networking.k8s.io/v1 Ingress routing every domain, alias
+// and network name of c to the backend service.
+func Ingress(c *cfg.Config, o Options) ([]byte, error) {
+	obj := ingress{
+		APIVersion: "networking.k8s.io/v1",
+		Kind:       "Ingress",
+		Metadata:   objectMeta{Name: o.Name, Namespace: o.Namespace},
+		Spec:       ingressSpec{IngressClassName: o.IngressClass},
+	}
+	path := ingressPath{
+		Path:     "/",
+		PathType: "Prefix",
+		Backend:  ingressBackend{Service: serviceBackend{Name: o.Service, Port: servicePort{Number: o.Port}}},
+	}
+	for _, d := range domains(c) {
+		if o.TLS {
+			obj.Spec.TLS = append(obj.Spec.TLS, ingressTLS{Hosts: d.Hostnames, SecretName: o.secretName(d)})
+		}
+		for _, host := range d.Hostnames {
+			obj.Spec.Rules = append(obj.Spec.Rules, ingressRule{
+				Host: host,
+				HTTP: ingressRuleValue{Paths: []ingressPath{path}},
+			})
+		}
+	}
+	return marshal(obj)
+}
+
+type httpRoute struct {
+	APIVersion string        `yaml:"apiVersion"`
+	Kind       string        `yaml:"kind"`
+	Metadata   objectMeta    `yaml:"metadata"`
+	Spec       httpRouteSpec `yaml:"spec"`
+}
+
+type httpRouteSpec struct {
+	ParentRefs []objectMeta    `yaml:"parentRefs"`
+	Hostnames  []string        `yaml:"hostnames"`
+	Rules      []httpRouteRule `yaml:"rules"`
+}
+
+type httpRouteRule struct {
+	Matches     []httpRouteMatch `yaml:"matches"`
+	BackendRefs []backendRef     `yaml:"backendRefs"`
+}
+
+type httpRouteMatch struct {
+	Path httpPathMatch `yaml:"path"`
+}
+
+type httpPathMatch struct {
+	Type  string `yaml:"type"`
+	Value string `yaml:"value"`
+}
+
+type backendRef struct {
+	Name string `yaml:"name"`
+	Port int    `yaml:"port"`
+}
+
+// HTTPRoute renders a Gateway API HTTPRoute attaching every domain, alias and
+// network name of c to the gateway and routing them to the backend service.
+// TLS is configured on the gateway's listeners rather than on routes.
+func HTTPRoute(c *cfg.Config, o Options) ([]byte, error) {
+	obj := httpRoute{
+		APIVersion: "gateway.networking.k8s.io/v1",
+		Kind:       "HTTPRoute",
+		Metadata:   objectMeta{Name: o.Name, Namespace: o.Namespace},
+		Spec: httpRouteSpec{
+			ParentRefs: []objectMeta{{Name: o.Gateway, Namespace: o.GatewayNamespace}},
+			Rules: []httpRouteRule{{
+				Matches:     []httpRouteMatch{{Path: httpPathMatch{Type: "PathPrefix", Value: "/"}}},
+				BackendRefs: []backendRef{{Name: o.Service, Port: o.Port}},
+			}},
+		},
+	}
+	for _, d := range domains(c) {
+		obj.Spec.Hostnames = append(obj.Spec.Hostnames, d.Hostnames...)
+	}
+	return marshal(obj)
+}
+
+// marshal encodes v as YAML with the two-space indentation of Kubernetes
+// manifests.
+func marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
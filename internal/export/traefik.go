@@ -0,0 +1,107 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// traefikServiceName is the name of the service every router points at.
+const traefikServiceName = "mwpfm"
+
+type traefikConfig struct {
+	HTTP traefikHTTP `yaml:"http"`
+}
+
+type traefikHTTP struct {
+	Routers  map[string]traefikRouter  `yaml:"routers"`
+	Services map[string]traefikService `yaml:"services"`
+}
+
+type traefikRouter struct {
+	Rule        string      `yaml:"rule"`
+	Service     string      `yaml:"service"`
+	EntryPoints []string    `yaml:"entryPoints,omitempty"`
+	TLS         *traefikTLS `yaml:"tls,omitempty"`
+}
+
+type traefikTLS struct {
+	CertResolver string `yaml:"certResolver,omitempty"`
+}
+
+type traefikService struct {
+	LoadBalancer traefikLoadBalancer `yaml:"loadBalancer"`
+}
+
+type traefikLoadBalancer struct {
+	Servers []traefikServer `yaml:"servers"`
+}
+
+type traefikServer struct {
+	URL string `yaml:"url"`
+}
+
+// Traefik renders a Traefik file-provider dynamic configuration with a router
+// per domain of c, matching its aliases and network names, all pointing at
+// the proxy at t.URL.
+func Traefik(c *cfg.Config, t cfg.Traefik) ([]byte, error) {
+	obj := traefikConfig{HTTP: traefikHTTP{
+		Routers: map[string]traefikRouter{},
+		Services: map[string]traefikService{
+			traefikServiceName: {LoadBalancer: traefikLoadBalancer{Servers: []traefikServer{{URL: t.URL}}}},
+		},
+	}}
+	for _, d := range domains(c) {
+		rules := make([]string, 0, len(d.Hostnames))
+		for _, host := range d.Hostnames {
+			rules = append(rules, hostRule(host))
+		}
+		router := traefikRouter{
+			Rule:        strings.Join(rules, " || "),
+			Service:     traefikServiceName,
+			EntryPoints: t.EntryPoints,
+		}
+		if t.CertResolver != "" {
+			router.TLS = &traefikTLS{CertResolver: t.CertResolver}
+		}
+		obj.HTTP.Routers["mwpfm-"+slug(d.Name)] = router
+	}
+	return marshal(obj)
+}
+
+// hostRule returns the Traefik v3 rule matching a hostname. Wildcards match
+// a single label, like they do in Kubernetes routes and certificates. Apache
+// wildcard aliases match any number of labels, so names several levels deep
+// are accepted by the vhost but not routed to it.
+func hostRule(host string) string {
+	if rest, ok := strings.CutPrefix(host, "*."); ok {
+		return fmt.Sprintf("HostRegexp(`^[^.]+\\.%s$`)", regexp.QuoteMeta(rest))
+	}
+	return fmt.Sprintf("Host(`%s`)", host)
+}
+
+// WriteTraefik writes the Traefik configuration of c to t.File. The file is
+// replaced atomically, and left untouched when its content is unchanged so
+// Traefik only reloads on actual changes.
+func WriteTraefik(c *cfg.Config, t cfg.Traefik) error {
+	data, err := Traefik(c, t)
+	if err != nil {
+		return fmt.Errorf("render traefik config: %w", err)
+	}
+	if current, err := os.ReadFile(t.File); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(t.File), 0o755); err != nil {
+		return err
+	}
+	tmp := t.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.File)
+}
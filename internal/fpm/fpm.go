@@ -0,0 +1,281 @@
+package fpm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+const (
+	DefaultPoolDir   = "/etc/php/pools.d"
+	DefaultSocketDir = "/run/php"
+	DefaultTmpDir    = "/var/lib/mwpfm/tmp"
+
+	// poolPrefix marks the pool files owned by the controller, so stale ones
+	// can be removed without touching pools installed by other means.
+	poolPrefix = "mwpfm-"
+)
+
+// Manager writes one PHP-FPM pool configuration per site. PHP-FPM is reloaded
+// by the container whenever the pool directory changes, just like Apache is
+// for sites-enabled.
+type Manager struct {
+	PoolDir   string
+	SocketDir string
+	TmpDir    string
+}
+
+// New returns a Manager for the given settings, filling in defaults.
+func New(c cfg.FPM) *Manager {
+	m := &Manager{PoolDir: c.PoolDir, SocketDir: c.SocketDir, TmpDir: c.TmpDir}
+	if m.PoolDir == "" {
+		m.PoolDir = DefaultPoolDir
+	}
+	if m.SocketDir == "" {
+		m.SocketDir = DefaultSocketDir
+	}
+	if m.TmpDir == "" {
+		m.TmpDir = DefaultTmpDir
+	}
+	return m
+}
+
+// SocketPath returns the socket the pool of a site listens on.
+func (m *Manager) SocketPath(site cfg.Site) string {
+	return filepath.Join(m.SocketDir, poolPrefix+site.ID()+".sock")
+}
+
+// SiteTmpDir returns the temporary directory of a site's pool.
+func (m *Manager) SiteTmpDir(site cfg.Site) string {
+	return filepath.Join(m.TmpDir, site.ID())
+}
+
+func (m *Manager) poolPath(id string) string {
+	return filepath.Join(m.PoolDir, poolPrefix+id+".conf")
+}
+
+// poolData is the input of poolTemplate.
+type poolData struct {
+	Name     string
+	Socket   string
+	SitePath string
+	TmpDir   string
+	Pool     cfg.FPMPool
+	Settings []Setting
+}
+
+var poolTemplate = template.Must(template.New("pool").Parse(`; Managed by multi-wordpress-file-manager; changes will be overwritten.
+[{{ .Name }}]
+user = {{ .Pool.User }}
+group = {{ .Pool.Group }}
+
+listen = {{ .Socket }}
+listen.owner = www-data
+listen.group = www-data
+listen.mode = 0660
+
+pm = {{ .Pool.PM }}
+pm.max_children = {{ .Pool.MaxChildren }}
+{{- if eq .Pool.PM "dynamic" }}
+pm.start_servers = {{ .Pool.StartServers }}
+pm.min_spare_servers = {{ .Pool.MinSpareServers }}
+pm.max_spare_servers = {{ .Pool.MaxSpareServers }}
+{{- end }}
+pm.max_requests = {{ .Pool.MaxRequests }}
+
+php_admin_value[open_basedir] = {{ .SitePath }}:{{ .TmpDir }}
+{{- range .Settings }}
+php_admin_value[{{ .Key }}] = {{ .Value }}
+{{- end }}
+php_admin_value[upload_tmp_dir] = {{ .TmpDir }}
+php_admin_value[sys_temp_dir] = {{ .TmpDir }}
+php_admin_value[session.save_path] = {{ .TmpDir }}
+`))
+
+// Setting is a php.ini setting applied to a site.
+type Setting struct {
+	Key, Value string
+}
+
+// Settings returns the php.ini overrides of a site sorted by key. The pool's
+// own upload_max_filesize and memory_limit take precedence over the site's
+// general PHP settings.
+func Settings(site cfg.Site) []Setting {
+	values := map[string]string{}
+	for k, v := range site.PHP {
+		values[k] = v
+	}
+	if site.FPM != nil {
+		if site.FPM.UploadMaxFilesize != "" {
+			values["upload_max_filesize"] = site.FPM.UploadMaxFilesize
+		}
+		if site.FPM.MemoryLimit != "" {
+			values["memory_limit"] = site.FPM.MemoryLimit
+		}
+	}
+	settings := make([]Setting, 0, len(values))
+	for k, v := range values {
+		settings = append(settings, Setting{k, v})
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return settings
+}
+
+// withDefaults fills in the zero values of p.
+func withDefaults(p *cfg.FPMPool) cfg.FPMPool {
+	var pool cfg.FPMPool
+	if p != nil {
+		pool = *p
+	}
+	if pool.User == "" {
+		pool.User = "www-data"
+	}
+	if pool.Group == "" {
+		pool.Group = "www-data"
+	}
+	if pool.PM == "" {
+		pool.PM = "dynamic"
+	}
+	if pool.MaxChildren == 0 {
+		pool.MaxChildren = 5
+	}
+	if pool.StartServers == 0 {
+		pool.StartServers = min(2, pool.MaxChildren)
+	}
+	if pool.MinSpareServers == 0 {
+		pool.MinSpareServers = 1
+	}
+	if pool.MaxSpareServers == 0 {
+		pool.MaxSpareServers = max(pool.StartServers, min(3, pool.MaxChildren))
+	}
+	if pool.MaxRequests == 0 {
+		pool.MaxRequests = 500
+	}
+	return pool
+}
+
+// Configure writes the pool configuration of a site, confining its scripts to
+// sitePath and its own temporary directory, which keeps the uploads, sessions
+// and temporary files of one site out of reach of the others. The file is
+// left untouched when its content is unchanged so the pool is only reloaded
+// on actual changes.
+func (m *Manager) Configure(site cfg.Site, sitePath string) error {
+	pool := withDefaults(site.FPM)
+	tmpDir := m.SiteTmpDir(site)
+	if err := ensureTmpDir(tmpDir, pool); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	err := poolTemplate.Execute(&buf, poolData{
+		Name:     site.ID(),
+		Socket:   m.SocketPath(site),
+		SitePath: sitePath,
+		TmpDir:   tmpDir,
+		Pool:     pool,
+		Settings: Settings(site),
+	})
+	if err != nil {
+		return fmt.Errorf("render pool: %w", err)
+	}
+	path := m.poolPath(site.ID())
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, buf.Bytes()) {
+		return nil
+	}
+	if err := os.MkdirAll(m.PoolDir, 0o755); err != nil {
+		return fmt.Errorf("create pool dir: %w", err)
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// ensureTmpDir creates the temporary directory of a pool, accessible to the
+// pool's user and group only. The directory is handed over to them when they
+// are not the default www-data, which needs the controller to run as root.
+func ensureTmpDir(dir string, pool cfg.FPMPool) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("create tmp dir: %w", err)
+	}
+	if err := os.Chmod(dir, 0o700); err != nil {
+		return fmt.Errorf("create tmp dir: %w", err)
+	}
+	if pool.User == "www-data" && pool.Group == "www-data" {
+		return nil
+	}
+	u, err := user.Lookup(pool.User)
+	if err != nil {
+		return fmt.Errorf("tmp dir owner: %w", err)
+	}
+	g, err := user.LookupGroup(pool.Group)
+	if err != nil {
+		return fmt.Errorf("tmp dir group: %w", err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(g.Gid)
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return fmt.Errorf("tmp dir owner: %w", err)
+	}
+	return nil
+}
+
+// Prune removes the pools and temporary directories of sites that are no
+// longer configured.
+func (m *Manager) Prune(sites []cfg.Site) error {
+	if err := m.pruneTmpDirs(sites); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(m.PoolDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read pool dir: %w", err)
+	}
+	keep := map[string]bool{}
+	for _, site := range sites {
+		keep[filepath.Base(m.poolPath(site.ID()))] = true
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, poolPrefix) || !strings.HasSuffix(name, ".conf") || keep[name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(m.PoolDir, name)); err != nil {
+			return fmt.Errorf("remove stale pool %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// pruneTmpDirs removes the temporary directories of sites that are no longer
+// configured. Everything under TmpDir belongs to a pool.
+func (m *Manager) pruneTmpDirs(sites []cfg.Site) error {
+	entries, err := os.ReadDir(m.TmpDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read tmp dir: %w", err)
+	}
+	keep := map[string]bool{}
+	for _, site := range sites {
+		keep[site.ID()] = true
+	}
+	for _, e := range entries {
+		if keep[e.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(m.TmpDir, e.Name())); err != nil {
+			return fmt.Errorf("remove stale tmp dir %s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package fpm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+func TestPoolsHaveTheirOwnTmpDir(t *testing.T) {
+	dir := t.TempDir()
+	m := New(cfg.FPM{PoolDir: filepath.Join(dir, "pools"), SocketDir: filepath.Join(dir, "run"), TmpDir: filepath.Join(dir, "tmp")})
+	sites := []cfg.Site{{DomainName: "site1.example.com"}, {DomainName: "site2.example.com"}}
+	for _, site := range sites {
+		if err := m.Configure(site, filepath.Join(dir, "www", site.ID())); err != nil {
+			t.Fatalf("Configure %s: %v", site.DomainName, err)
+		}
+	}
+
+	for _, site := range sites {
+		tmp := m.SiteTmpDir(site)
+		info, err := os.Stat(tmp)
+		if err != nil {
+			t.Fatalf("tmp dir of %s: %v", site.DomainName, err)
+		}
+		if perm := info.Mode().Perm(); perm != 0o700 {
+			t.Errorf("tmp dir of %s has mode %o, want 700", site.DomainName, perm)
+		}
+		data, err := os.ReadFile(m.poolPath(site.ID()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := string(data)
+		for _, want := range []string{
+			"open_basedir] = " + filepath.Join(dir, "www", site.ID()) + ":" + tmp + "\n",
+			"upload_tmp_dir] = " + tmp + "\n",
+			"sys_temp_dir] = " + tmp + "\n",
+			"session.save_path] = " + tmp + "\n",
+		} {
+			if !strings.Contains(pool, want) {
+				t.Errorf("pool of %s lacks %q", site.DomainName, want)
+			}
+		}
+		if strings.Contains(pool, ":/tmp\n") {
+			t.Errorf("pool of %s shares /tmp", site.DomainName)
+		}
+	}
+
+	if err := m.Prune(sites[:1]); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if _, err := os.Stat(m.SiteTmpDir(sites[1])); !os.IsNotExist(err) {
+		t.Errorf("tmp dir of removed site kept: %v", err)
+	}
+	if _, err := os.Stat(m.SiteTmpDir(sites[0])); err != nil {
+		t.Errorf("tmp dir of configured site removed: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Defaults of LeaseOptions, matching those of Kubernetes controllers.
+const (
+	DefaultLeaseDuration = 15 * time.Second
+	DefaultRenewDeadline = 10 * time.Second
+	DefaultRetryPeriod   = 2 * time.Second
+)
+
+// LeaseOptions configure AcquireLease.
+type LeaseOptions struct {
+	// Namespace and Name of the coordination.k8s.io/v1 Lease.
+	Namespace string
+	Name      string
+	// LeaseDuration is how long other members wait before taking over a
+	// lease that is not renewed, RenewDeadline how long the holder keeps
+	// retrying a renewal before giving up leadership, and RetryPeriod how
+	// often both try. Defaults are used for zero values.
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// AcquireLease acquires leadership through a Kubernetes Lease, which unlike
+// Acquire needs no shared filesystem. The lease is renewed in the background
+// until the lock is released; if it cannot be renewed within RenewDeadline,
+// the lock reports itself lost. The fencing token is the lease's transition
+// count, which electors increment whenever the holder changes. If the
+// context is canceled before leadership is acquired, it returns the context
+// error.
+func AcquireLease(ctx context.Context, client kubernetes.Interface, member string, opts LeaseOptions) (*Lock, error) {
+	if opts.LeaseDuration == 0 {
+		opts.LeaseDuration = DefaultLeaseDuration
+	}
+	if opts.RenewDeadline == 0 {
+		opts.RenewDeadline = DefaultRenewDeadline
+	}
+	if opts.RetryPeriod == 0 {
+		opts.RetryPeriod = DefaultRetryPeriod
+	}
+	if member == "" {
+		return nil, errors.New("lease lock: member is required")
+	}
+
+	var (
+		mu        sync.Mutex
+		releasing bool
+		l         *Lock
+	)
+	acquired := make(chan struct{})
+	runCtx, cancel := context.WithCancel(context.Background())
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: opts.Namespace, Name: opts.Name},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: member},
+		},
+		LeaseDuration:   opts.LeaseDuration,
+		RenewDeadline:   opts.RenewDeadline,
+		RetryPeriod:     opts.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            opts.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) { close(acquired) },
+			OnStoppedLeading: func() {
+				mu.Lock()
+				lost := !releasing
+				mu.Unlock()
+				select {
+				case <-acquired:
+				default:
+					// Never led; the elector stopped while waiting.
+					return
+				}
+				if lost {
+					l.markLost()
+				}
+			},
+		},
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	l = newLock(func() error {
+		mu.Lock()
+		releasing = true
+		mu.Unlock()
+		cancel()
+		<-done
+		return nil
+	})
+	go func() {
+		defer close(done)
+		elector.Run(runCtx)
+	}()
+
+	select {
+	case <-acquired:
+	case <-ctx.Done():
+		l.Release()
+		return nil, ctx.Err()
+	}
+	token, err := leaseFence(ctx, client, member, opts)
+	if err != nil {
+		l.Release()
+		return nil, err
+	}
+	l.token = token
+	l.check = func(ctx context.Context) error {
+		// Bounded like a renewal, so a check never outlasts the lease.
+		ctx, cancel := context.WithTimeout(ctx, opts.RenewDeadline)
+		defer cancel()
+		cur, err := leaseFence(ctx, client, member, opts)
+		if err != nil {
+			return err
+		}
+		if cur != token {
+			return fmt.Errorf("%w: token %d, current %d", ErrStaleFence, token, cur)
+		}
+		return nil
+	}
+	return l, nil
+}
+
+// leaseFence returns the transition count of the lease, or ErrStaleFence if
+// it is held by another member.
+func leaseFence(ctx context.Context, client kubernetes.Interface, member string, opts LeaseOptions) (uint64, error) {
+	lease, err := client.CoordinationV1().Leases(opts.Namespace).Get(ctx, opts.Name, metav1.GetOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("check fencing token: %w", err)
+	}
+	if holder := lease.Spec.HolderIdentity; holder == nil || *holder != member {
+		return 0, fmt.Errorf("%w: lease held by another member", ErrStaleFence)
+	}
+	if lease.Spec.LeaseTransitions == nil {
+		return 0, nil
+	}
+	return uint64(*lease.Spec.LeaseTransitions), nil
+}
+
+// LeaseBackend keeps locks as Leases named after Options.Name and the key,
+// e.g. multi-wordpress.sites.example.com. Counting them needs permission to
+// list Leases.
+type LeaseBackend struct {
+	Client  kubernetes.Interface
+	Options LeaseOptions
+}
+
+// TryAcquire implements Backend.
+func (b LeaseBackend) TryAcquire(ctx context.Context, key, member string) (*Lock, error) {
+	opts := b.Options
+	opts.Name = b.name(key)
+	lease, err := b.Client.CoordinationV1().Leases(opts.Namespace).Get(ctx, opts.Name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return nil, err
+	case leaseHeld(lease) && *lease.Spec.HolderIdentity != member:
+		return nil, nil
+	}
+	// A free lease is acquired on the first attempt.
+	retry := opts.RetryPeriod
+	if retry == 0 {
+		retry = DefaultRetryPeriod
+	}
+	ctx, cancel := context.WithTimeout(ctx, retry)
+	defer cancel()
+	l, err := AcquireLease(ctx, b.Client, member, opts)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, nil
+	}
+	return l, err
+}
+
+// Count implements Backend.
+func (b LeaseBackend) Count(ctx context.Context, prefix string) (int, error) {
+	leases, err := b.Client.CoordinationV1().Leases(b.Options.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+	name := b.name(prefix)
+	n := 0
+	for i := range leases.Items {
+		if strings.HasPrefix(leases.Items[i].Name, name) && leaseHeld(&leases.Items[i]) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// name returns the name of the Lease of key. Slashes become dots and other
+// characters not allowed in object names become dashes.
+func (b LeaseBackend) name(key string) string {
+	return b.Options.Name + "." + strings.Map(func(r rune) rune {
+		switch {
+		case r == '/':
+			return '.'
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, key)
+}
+
+// leaseHeld reports whether a lease has a holder that renewed it within its
+// duration.
+func leaseHeld(lease *coordinationv1.Lease) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	return time.Since(spec.RenewTime.Time) < time.Duration(*spec.LeaseDurationSeconds)*time.Second
+}
@@ -0,0 +1,156 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fastLease renews leases quickly so tests do not wait on the defaults.
+var fastLease = LeaseOptions{
+	Namespace:     "default",
+	Name:          "mwpfm",
+	LeaseDuration: time.Second,
+	RenewDeadline: 500 * time.Millisecond,
+	RetryPeriod:   100 * time.Millisecond,
+}
+
+func acquireLease(t *testing.T, client *fake.Clientset, member string) *Lock {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l, err := AcquireLease(ctx, client, member, fastLease)
+	if err != nil {
+		t.Fatalf("AcquireLease(%s): %v", member, err)
+	}
+	t.Cleanup(func() { l.Release() })
+	return l
+}
+
+func waitLost(t *testing.T, l *Lock) {
+	t.Helper()
+	select {
+	case <-l.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("lost lease not noticed")
+	}
+}
+
+func TestLeaseTakeover(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	// Once taken over, the lease can no longer be renewed by its previous
+	// holder, whose copy is outdated.
+	var taken atomic.Bool
+	client.PrependReactor("update", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		lease := action.(k8stesting.UpdateAction).GetObject().(*coordinationv1.Lease)
+		if taken.Load() && *lease.Spec.HolderIdentity == "first" {
+			return true, nil, apierrors.NewConflict(coordinationv1.Resource("leases"), lease.Name, errors.New("taken over"))
+		}
+		return false, nil, nil
+	})
+	first := acquireLease(t, client, "first")
+	if err := first.CheckFence(context.Background()); err != nil {
+		t.Fatalf("CheckFence of the holder: %v", err)
+	}
+
+	// Another member took over, e.g. after a network partition.
+	taken.Store(true)
+	leases := client.CoordinationV1().Leases(fastLease.Namespace)
+	lease, err := leases.Get(context.Background(), fastLease.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder, transitions := "second", *lease.Spec.LeaseTransitions+1
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.LeaseTransitions = &transitions
+	renewed := metav1.NewMicroTime(time.Now().Add(time.Hour))
+	lease.Spec.RenewTime = &renewed
+	if _, err := leases.Update(context.Background(), lease, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.CheckFence(context.Background()); !errors.Is(err, ErrStaleFence) {
+		t.Errorf("CheckFence after the takeover = %v, want a stale fence", err)
+	}
+	waitLost(t, first)
+}
+
+func TestLeaseLostWhenRenewalsFail(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	// Reactors cannot be added while the lease is renewed.
+	var unreachable atomic.Bool
+	client.PrependReactor("update", "leases", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if unreachable.Load() {
+			return true, nil, errors.New("apiserver unreachable")
+		}
+		return false, nil, nil
+	})
+	l := acquireLease(t, client, "holder")
+
+	unreachable.Store(true)
+	waitLost(t, l)
+	if err := l.CheckFence(context.Background()); !errors.Is(err, ErrStaleFence) {
+		t.Errorf("CheckFence = %v, want a stale fence", err)
+	}
+}
+
+func TestLeaseBackend(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	b := LeaseBackend{Client: client, Options: fastLease}
+	ctx := context.Background()
+
+	first, err := b.TryAcquire(ctx, "sites/example.com", "first")
+	if err != nil || first == nil {
+		t.Fatalf("TryAcquire of a free lock = %v, %v", first, err)
+	}
+	if l, err := b.TryAcquire(ctx, "sites/example.com", "second"); err != nil || l != nil {
+		t.Fatalf("TryAcquire of a held lock = %v, %v, want nil", l, err)
+	}
+	other, err := b.TryAcquire(ctx, "sites/example.org", "second")
+	if err != nil || other == nil {
+		t.Fatalf("TryAcquire of another lock = %v, %v", other, err)
+	}
+	defer other.Release()
+	if n, err := b.Count(ctx, "sites/"); err != nil || n != 2 {
+		t.Errorf("Count = %d, %v, want 2", n, err)
+	}
+
+	// Released leases are free, and the next holder gets a newer token.
+	if err := first.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.Count(ctx, "sites/"); err != nil || n != 1 {
+		t.Errorf("Count after a release = %d, %v, want 1", n, err)
+	}
+	second, err := b.TryAcquire(ctx, "sites/example.com", "second")
+	if err != nil || second == nil {
+		t.Fatalf("TryAcquire of a released lock = %v, %v", second, err)
+	}
+	defer second.Release()
+	if second.Token() <= first.Token() {
+		t.Errorf("token after a change of holder = %d, want more than %d", second.Token(), first.Token())
+	}
+}
+
+func TestLeaseName(t *testing.T) {
+	b := LeaseBackend{Options: LeaseOptions{Name: "mwpfm"}}
+	tests := []struct{ key, want string }{
+		{"global", "mwpfm.global"},
+		{"sites/Example.COM", "mwpfm.sites.example.com"},
+		{"members/eu/pod_1", "mwpfm.members.eu.pod-1"},
+	}
+	for _, tt := range tests {
+		if got := b.name(tt.key); got != tt.want {
+			t.Errorf("name(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -5,8 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gofrs/flock"
@@ -18,33 +24,213 @@ type Info struct {
 	Hostname string    `json:"hostname"`
 	PID      int       `json:"pid"`
 	Acquired time.Time `json:"acquired"`
+	// Heartbeat is when the holder was last known to be alive. It is
+	// refreshed every TTL/3 in lease mode.
+	Heartbeat time.Time `json:"heartbeat"`
+	// Fence is the fencing token of the acquisition.
+	Fence uint64 `json:"fence"`
+}
+
+// checkInterval is how often a holder checks that it still holds the lock.
+const checkInterval = 5 * time.Second
+
+// ErrStaleFence is returned when the fencing token of a lock is no longer
+// the current one, meaning another member acquired the lock since.
+var ErrStaleFence = errors.New("lock: stale fencing token")
+
+// Lock is a held lock.
+type Lock struct {
+	token    uint64
+	check    func(ctx context.Context) error
+	lost     chan struct{}
+	lostOnce sync.Once
+	release  func() error
+	relOnce  sync.Once
+	relErr   error
+}
+
+func newLock(release func() error) *Lock {
+	return &Lock{lost: make(chan struct{}), release: release}
+}
+
+// Token returns the fencing token of the acquisition. Tokens increase with
+// every acquisition of the same lock.
+func (l *Lock) Token() uint64 { return l.token }
+
+// CheckFence returns an error wrapping ErrStaleFence if the lock was lost or
+// another member acquired it since, and nil if the token is still current.
+// Writes to the resources the lock protects should be preceded by a check.
+func (l *Lock) CheckFence(ctx context.Context) error {
+	if l.isLost() {
+		return ErrStaleFence
+	}
+	return l.check(ctx)
+}
+
+// Leader is the lock a member competes for, whether it currently holds it or
+// not. Work done under WithLeader keeps running while the lock is not held,
+// but only writes to the resources the lock protects while it is.
+type Leader struct {
+	mu sync.Mutex
+	l  *Lock
+}
+
+// Set records l as the lock held, or nil once it is released.
+func (ld *Leader) Set(l *Lock) {
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+	ld.l = l
+}
+
+// Lock returns the lock held, or nil if it is not held or was lost.
+func (ld *Leader) Lock() *Lock {
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+	if ld.l == nil || ld.l.isLost() {
+		return nil
+	}
+	return ld.l
+}
+
+type leaderKey struct{}
+
+// WithLeader returns a copy of ctx carrying ld, for Holds and CheckFence.
+func WithLeader(ctx context.Context, ld *Leader) context.Context {
+	return context.WithValue(ctx, leaderKey{}, ld)
+}
+
+// CheckFence checks the fencing token of the lock carried by ctx, if any:
+// the one of the Leader set with WithLeader, which must be held, or, under
+// site locks, the lock of the domain set with ForSite, or the global lock
+// without one, which must still be held.
+func CheckFence(ctx context.Context) error {
+	if ld, ok := ctx.Value(leaderKey{}).(*Leader); ok {
+		l := ld.Lock()
+		if l == nil {
+			return fmt.Errorf("%w: lock not held", ErrStaleFence)
+		}
+		return l.CheckFence(ctx)
+	}
+	s, ok := ctx.Value(siteLocksKey{}).(*SiteLocks)
+	if !ok {
+		return nil
+	}
+	domain, forSite := ctx.Value(siteKeyKey{}).(string)
+	if !forSite {
+		l := s.globalLock()
+		if l == nil {
+			return fmt.Errorf("%w: global lock not held", ErrStaleFence)
+		}
+		return l.CheckFence(ctx)
+	}
+	l := s.lock(domain)
+	if l == nil {
+		return fmt.Errorf("%w: lock of %s no longer held", ErrStaleFence, domain)
+	}
+	return l.CheckFence(ctx)
+}
+
+// Lost returns a channel that is closed when the lock is found to be no
+// longer held, e.g. because another member took it over. The holder must
+// then stop using the resources the lock protects.
+func (l *Lock) Lost() <-chan struct{} { return l.lost }
+
+// Release releases the lock. Calling it more than once is a no-op.
+func (l *Lock) Release() error {
+	l.relOnce.Do(func() { l.relErr = l.release() })
+	return l.relErr
+}
+
+func (l *Lock) markLost() {
+	l.lostOnce.Do(func() { close(l.lost) })
+}
+
+func (l *Lock) isLost() bool {
+	select {
+	case <-l.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// Options configure how a lock is acquired and held.
+type Options struct {
+	// TTL enables lease mode. The holder refreshes the heartbeat in the
+	// sidecar every TTL/3, and a waiter takes over a lock whose heartbeat
+	// is older than TTL even if the file still appears locked, which happens
+	// when a holder dies on a filesystem with unreliable flock semantics.
+	TTL time.Duration
+	// Logf reports takeovers and lost locks; log.Printf if nil.
+	Logf func(format string, args ...any)
 }
 
 // Acquire tries to acquire an exclusive lock on the given file path. The lock
-// is kept until the returned release function is called, or the process exits.
-// If the context is canceled before the lock is acquired, it returns context error.
-func Acquire(ctx context.Context, path string, member string) (release func() error, _ error) {
+// is kept until it is released, or the process exits. While it is held, the
+// lock file and its sidecar are checked periodically and the lock reports
+// itself lost if the file was removed or replaced, or the sidecar names
+// another holder. If the context is canceled before the lock is acquired, it
+// returns context error.
+func Acquire(ctx context.Context, path string, member string, opts Options) (*Lock, error) {
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return nil, fmt.Errorf("ensure lock dir: %w", err)
 	}
-	f := flock.New(path)
+	if opts.Logf == nil {
+		opts.Logf = log.Printf
+	}
+	infoPath := path + ".json"
+	info := newInfo(member)
 
 	// Attempt to acquire with polling so we can respect context.
 	ticker := time.NewTicker(250 * time.Millisecond)
 	defer ticker.Stop()
 
 	for {
+		f := flock.New(path)
 		locked, err := f.TryLock()
 		if err != nil {
 			return nil, fmt.Errorf("try lock: %w", err)
 		}
+		if !locked && opts.TTL > 0 {
+			f, locked, err = takeOver(path, info, opts)
+			if err != nil {
+				return nil, err
+			}
+		}
 		if locked {
-			// Write sidecar info for visibility (best-effort).
-			_ = writeInfo(path+".json", member)
-			return func() error {
-				_ = os.Remove(path + ".json")
+			fi, err := os.Stat(path)
+			if err != nil {
+				_ = f.Unlock()
+				return nil, fmt.Errorf("stat lock: %w", err)
+			}
+			if info.Fence, err = nextFence(path); err != nil {
+				_ = f.Unlock()
+				return nil, err
+			}
+			// The sidecar carries the fencing token, so it must be written.
+			if err := writeInfo(infoPath, info); err != nil {
+				_ = f.Unlock()
+				return nil, fmt.Errorf("write lock info: %w", err)
+			}
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			var l *Lock
+			l = newLock(func() error {
+				close(stop)
+				<-done
+				// A lost lock's sidecar belongs to the new holder.
+				if !l.isLost() {
+					_ = os.Remove(infoPath)
+				}
 				return f.Unlock()
-			}, nil
+			})
+			l.token = info.Fence
+			l.check = func(context.Context) error { return checkFence(path, info) }
+			go func() {
+				defer close(done)
+				hold(l, path, fi, info, opts, stop)
+			}()
+			return l, nil
 		}
 		select {
 		case <-ctx.Done():
@@ -54,18 +240,245 @@ func Acquire(ctx context.Context, path string, member string) (release func() er
 	}
 }
 
-func writeInfo(infoPath, member string) error {
+// takeOver replaces a lock whose holder's heartbeat is older than the TTL with
+// a fresh lock file held by the caller. Waiters serialize takeovers through a
+// second lock file and re-check the heartbeat under it, so a lock is only
+// taken over once.
+func takeOver(path string, info Info, opts Options) (*flock.Flock, bool, error) {
+	prev, err := ReadInfo(path)
+	if err != nil || !prev.expired(opts.TTL) {
+		return nil, false, nil
+	}
+	guard := flock.New(path + ".takeover")
+	locked, err := guard.TryLock()
+	if err != nil || !locked {
+		return nil, false, nil
+	}
+	defer guard.Unlock()
+
+	// Another waiter may have taken over while we were checking.
+	prev, err = ReadInfo(path)
+	if err != nil || !prev.expired(opts.TTL) {
+		return nil, false, nil
+	}
+	opts.Logf("lock: taking over %s from %s (host %s, pid %d, acquired %s, last heartbeat %s)",
+		path, prev.Member, prev.Hostname, prev.PID, prev.Acquired.Format(time.RFC3339), prev.lastSeen().Format(time.RFC3339))
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, false, fmt.Errorf("remove stale lock: %w", err)
+	}
+	f := flock.New(path)
+	locked, err = f.TryLock()
+	if err != nil {
+		return nil, false, fmt.Errorf("try lock: %w", err)
+	}
+	if locked {
+		// Written before releasing the guard so other waiters see the new
+		// holder as alive.
+		_ = writeInfo(path+".json", info)
+	}
+	return f, locked, nil
+}
+
+// hold checks that l is still held until stop is closed or the lock is lost,
+// refreshing the heartbeat in the sidecar in lease mode. fi describes the
+// lock file when it was locked.
+func hold(l *Lock, path string, fi os.FileInfo, info Info, opts Options, stop <-chan struct{}) {
+	interval := checkInterval
+	if opts.TTL > 0 && opts.TTL/3 < interval {
+		interval = opts.TTL / 3
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			// Checked before the heartbeat so a new holder's sidecar is
+			// never overwritten.
+			if reason := notHeld(path, fi, info); reason != "" {
+				opts.Logf("lock: lost %s: %s", path, reason)
+				l.markLost()
+				return
+			}
+			if opts.TTL > 0 {
+				info.Heartbeat = now
+				_ = writeInfo(path+".json", info)
+			}
+		}
+	}
+}
+
+// notHeld returns why the lock at path, locked by the process described by
+// info when the file was fi, is no longer held, or "" if it still is. A
+// missing sidecar is not a reason, as writing it is best-effort.
+func notHeld(path string, fi os.FileInfo, info Info) string {
+	cur, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "lock file removed"
+	}
+	if err != nil {
+		// Transient errors on shared filesystems are not taken as a loss.
+		return ""
+	}
+	if !os.SameFile(fi, cur) {
+		return "lock file replaced"
+	}
+	prev, err := ReadInfo(path)
+	if err != nil {
+		return ""
+	}
+	if prev.Member != info.Member || prev.Hostname != info.Hostname || prev.PID != info.PID {
+		return fmt.Sprintf("held by %s (host %s, pid %d)", prev.Member, prev.Hostname, prev.PID)
+	}
+	return ""
+}
+
+// nextFence increments the fencing counter of the lock at path, which must be
+// held, and returns the new value. The counter is kept in its own file as the
+// lock file and sidecar are replaced on takeovers.
+func nextFence(path string) (uint64, error) {
+	counterPath := path + ".fence"
+	var n uint64
+	b, err := os.ReadFile(counterPath)
+	switch {
+	case err == nil:
+		if n, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err != nil {
+			return 0, fmt.Errorf("parse fencing counter: %w", err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return 0, fmt.Errorf("read fencing counter: %w", err)
+	}
+	n++
+	tmp := fmt.Sprintf("%s.%d.tmp", counterPath, os.Getpid())
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(n, 10)+"\n"), 0o644); err != nil {
+		return 0, fmt.Errorf("write fencing counter: %w", err)
+	}
+	if err := os.Rename(tmp, counterPath); err != nil {
+		return 0, fmt.Errorf("write fencing counter: %w", err)
+	}
+	return n, nil
+}
+
+// checkFence compares the fencing token in info with the one in the current
+// sidecar of the lock at path.
+func checkFence(path string, info Info) error {
+	cur, err := ReadInfo(path)
+	if err != nil {
+		return fmt.Errorf("check fencing token: %w", err)
+	}
+	if cur.Fence != info.Fence {
+		return fmt.Errorf("%w: token %d, current %d held by %s (host %s, pid %d)",
+			ErrStaleFence, info.Fence, cur.Fence, cur.Member, cur.Hostname, cur.PID)
+	}
+	return nil
+}
+
+// Probe reports whether the lock at path is currently held, by trying to
+// lock it without waiting. A lock that is free is released right away.
+func Probe(path string) (held bool, _ error) {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	f := flock.New(path)
+	locked, err := f.TryLock()
+	if err != nil {
+		return false, fmt.Errorf("try lock: %w", err)
+	}
+	if locked {
+		return false, f.Unlock()
+	}
+	return true, nil
+}
+
+// Break removes the lock at path and its sidecar, so a waiter can acquire it
+// and a holder that is still running notices it lost the lock. Unless force
+// is set, the holder recorded in the sidecar must have run on this host and
+// its process must have exited.
+func Break(path string, force bool) error {
+	if !force {
+		info, err := ReadInfo(path)
+		if err != nil {
+			return fmt.Errorf("read lock info: %w", err)
+		}
+		host, _ := os.Hostname()
+		if info.Hostname != host {
+			return fmt.Errorf("holder %s ran on host %s, its process cannot be checked from %s", info.Member, info.Hostname, host)
+		}
+		if ProcessAlive(info.PID) {
+			return fmt.Errorf("holder %s is still running as pid %d", info.Member, info.PID)
+		}
+	}
+	for _, p := range []string{path, path + ".json"} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProcessAlive reports whether a process with the given PID runs on this
+// host.
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// ReadInfo reads the sidecar of the lock at path.
+func ReadInfo(path string) (Info, error) {
+	var info Info
+	b, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return info, fmt.Errorf("parse lock info: %w", err)
+	}
+	return info, nil
+}
+
+// lastSeen returns when the holder was last known to be alive. Sidecars
+// written before heartbeats existed only record when the lock was acquired.
+func (i Info) lastSeen() time.Time {
+	if i.Heartbeat.IsZero() {
+		return i.Acquired
+	}
+	return i.Heartbeat
+}
+
+func (i Info) expired(ttl time.Duration) bool {
+	return time.Since(i.lastSeen()) > ttl
+}
+
+func newInfo(member string) Info {
 	host, _ := os.Hostname()
-	b, _ := json.MarshalIndent(Info{
-		Member:   member,
-		Hostname: host,
-		PID:      os.Getpid(),
-		Acquired: time.Now(),
-	}, "", "  ")
+	now := time.Now()
+	return Info{
+		Member:    member,
+		Hostname:  host,
+		PID:       os.Getpid(),
+		Acquired:  now,
+		Heartbeat: now,
+	}
+}
+
+// writeInfo replaces the sidecar atomically, so readers never see a partial
+// write.
+func writeInfo(infoPath string, info Info) error {
+	b, _ := json.MarshalIndent(info, "", "  ")
 	if len(b) == 0 {
 		return errors.New("empty info")
 	}
-	// Best-effort write; ignore errors to avoid blocking lock acquisition.
-	_ = os.WriteFile(infoPath, b, 0o644)
-	return nil
+	tmp := fmt.Sprintf("%s.%d.tmp", infoPath, os.Getpid())
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, infoPath)
 }
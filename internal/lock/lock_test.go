@@ -0,0 +1,202 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// quiet discards the messages of the lock under test.
+func quiet(string, ...any) {}
+
+// holdDead locks path as a holder that died without releasing it would, with
+// a sidecar last refreshed age ago.
+func holdDead(t *testing.T, path string, age time.Duration) {
+	t.Helper()
+	f := flock.New(path)
+	if locked, err := f.TryLock(); err != nil || !locked {
+		t.Fatalf("lock %s: locked %v, %v", path, locked, err)
+	}
+	t.Cleanup(func() { f.Unlock() })
+	info := newInfo("dead")
+	info.PID = -1
+	info.Heartbeat = time.Now().Add(-age)
+	info.Acquired = info.Heartbeat
+	if err := writeInfo(path+".json", info); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireTakesOverExpiredLock(t *testing.T) {
+	const ttl = time.Second
+	tests := []struct {
+		name     string
+		age      time.Duration
+		opts     Options
+		takeover bool
+	}{
+		{name: "expired heartbeat", age: 2 * ttl, opts: Options{TTL: ttl, Logf: quiet}, takeover: true},
+		{name: "fresh heartbeat", age: 0, opts: Options{TTL: ttl, Logf: quiet}},
+		{name: "no lease mode", age: 2 * ttl, opts: Options{Logf: quiet}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "reconcile.lock")
+			holdDead(t, path, tt.age)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			l, err := Acquire(ctx, path, "waiter", tt.opts)
+			if !tt.takeover {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("Acquire = %v, want to keep waiting", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Acquire: %v", err)
+			}
+			defer l.Release()
+			info, err := ReadInfo(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Member != "waiter" || info.Fence != l.Token() {
+				t.Errorf("sidecar after takeover: member %s, fence %d, want waiter, %d", info.Member, info.Fence, l.Token())
+			}
+		})
+	}
+}
+
+func TestHolderNoticesLostLock(t *testing.T) {
+	tests := []struct {
+		name string
+		lose func(t *testing.T, path string)
+	}{
+		{"lock file removed", func(t *testing.T, path string) {
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"lock file replaced", func(t *testing.T, path string) {
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "reconcile.lock")
+			// Checked every 50ms.
+			l, err := Acquire(context.Background(), path, "holder", Options{TTL: 150 * time.Millisecond, Logf: quiet})
+			if err != nil {
+				t.Fatalf("Acquire: %v", err)
+			}
+			defer l.Release()
+
+			select {
+			case <-l.Lost():
+				t.Fatal("lock lost before anything happened")
+			case <-time.After(200 * time.Millisecond):
+			}
+			tt.lose(t, path)
+			select {
+			case <-l.Lost():
+			case <-time.After(2 * time.Second):
+				t.Fatal("lost lock not noticed")
+			}
+			if err := l.CheckFence(context.Background()); !errors.Is(err, ErrStaleFence) {
+				t.Errorf("CheckFence = %v, want a stale fence", err)
+			}
+		})
+	}
+}
+
+func TestFenceAfterTakeover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reconcile.lock")
+	first, err := Acquire(context.Background(), path, "first", Options{Logf: quiet})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer first.Release()
+	ld := &Leader{}
+	ld.Set(first)
+	ctx := WithLeader(context.Background(), ld)
+	if err := CheckFence(ctx); err != nil {
+		t.Fatalf("CheckFence of the holder: %v", err)
+	}
+
+	// The first holder stalls without refreshing its heartbeat.
+	info, err := ReadInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Heartbeat = time.Now().Add(-time.Minute)
+	if err := writeInfo(path+".json", info); err != nil {
+		t.Fatal(err)
+	}
+	second, err := Acquire(context.Background(), path, "second", Options{TTL: time.Second, Logf: quiet})
+	if err != nil {
+		t.Fatalf("takeover: %v", err)
+	}
+	defer second.Release()
+
+	if second.Token() != first.Token()+1 {
+		t.Errorf("token after takeover = %d, want %d", second.Token(), first.Token()+1)
+	}
+	if err := CheckFence(ctx); !errors.Is(err, ErrStaleFence) {
+		t.Errorf("CheckFence of the previous holder = %v, want a stale fence", err)
+	}
+	if err := second.CheckFence(context.Background()); err != nil {
+		t.Errorf("CheckFence of the new holder: %v", err)
+	}
+	if err := CheckFence(context.Background()); err != nil {
+		t.Errorf("CheckFence without a lock = %v, want nil", err)
+	}
+}
+
+func TestBreak(t *testing.T) {
+	tests := []struct {
+		name   string
+		dead   bool
+		force  bool
+		broken bool
+	}{
+		{name: "running holder", dead: false},
+		{name: "running holder, forced", dead: false, force: true, broken: true},
+		{name: "exited holder", dead: true, broken: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "reconcile.lock")
+			if tt.dead {
+				holdDead(t, path, 0)
+			} else {
+				l, err := Acquire(context.Background(), path, "holder", Options{Logf: quiet})
+				if err != nil {
+					t.Fatalf("Acquire: %v", err)
+				}
+				defer l.Release()
+			}
+			if held, err := Probe(path); err != nil || !held {
+				t.Fatalf("Probe = %v, %v, want held", held, err)
+			}
+
+			err := Break(path, tt.force)
+			if (err == nil) != tt.broken {
+				t.Fatalf("Break = %v, want broken %v", err, tt.broken)
+			}
+			if held, _ := Probe(path); held == tt.broken {
+				t.Errorf("Probe after Break = %v", held)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Backend acquires named locks without waiting, so a member can hold several
+// of them at once. Keys are slash-separated, e.g. sites/example.com.
+type Backend interface {
+	// TryAcquire acquires the lock named key for member, or returns nil if
+	// another member holds it.
+	TryAcquire(ctx context.Context, key, member string) (*Lock, error)
+	// Count returns how many locks whose key starts with prefix are held.
+	Count(ctx context.Context, prefix string) (int, error)
+}
+
+// FileBackend keeps locks as files under Dir, e.g. Dir/sites/example.com.lock.
+type FileBackend struct {
+	Dir     string
+	Options Options
+}
+
+// TryAcquire implements Backend.
+func (b FileBackend) TryAcquire(ctx context.Context, key, member string) (*Lock, error) {
+	// Acquire tries once before looking at the context.
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	l, err := Acquire(ctx, b.path(key), member, b.Options)
+	if errors.Is(err, context.Canceled) {
+		return nil, nil
+	}
+	return l, err
+}
+
+// Count implements Backend.
+func (b FileBackend) Count(_ context.Context, prefix string) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(b.Dir, filepath.FromSlash(prefix+"*")) + ".lock")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, p := range paths {
+		held, err := Probe(p)
+		if err != nil {
+			return 0, err
+		}
+		if held {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (b FileBackend) path(key string) string {
+	return filepath.Join(b.Dir, filepath.FromSlash(key)+".lock")
+}
+
+// SiteLocks holds the locks of the domains a member reconciles when the sites
+// are sharded between several controllers. Members sharing a group split the
+// domains they are eligible for evenly: each one holds a membership lock in
+// the group, so they can count each other, and takes at most its share of the
+// domains. When members come and go, Sync releases domains above the share
+// and picks up those left free. One member among all groups also holds the
+// global lock, for the shared files that are not specific to a domain.
+type SiteLocks struct {
+	backend    Backend
+	group      string
+	member     string
+	logf       func(format string, args ...any)
+	membership *Lock
+
+	mu     sync.Mutex
+	held   map[string]*Lock
+	global *Lock
+}
+
+// NewSiteLocks joins group as member. It fails if the membership lock is
+// held, e.g. by another process running as member. logf reports the domains
+// acquired and released; log.Printf if nil.
+func NewSiteLocks(ctx context.Context, b Backend, group, member string, logf func(format string, args ...any)) (*SiteLocks, error) {
+	if logf == nil {
+		logf = log.Printf
+	}
+	s := &SiteLocks{backend: b, group: group, member: member, logf: logf, held: map[string]*Lock{}}
+	l, err := b.TryAcquire(ctx, s.memberKey(), member)
+	if err != nil {
+		return nil, fmt.Errorf("join shard: %w", err)
+	}
+	if l == nil {
+		return nil, fmt.Errorf("join shard: member %s is already running", member)
+	}
+	s.membership = l
+	return s, nil
+}
+
+func (s *SiteLocks) memberPrefix() string { return "members/" + s.group + "/" }
+func (s *SiteLocks) memberKey() string    { return s.memberPrefix() + s.member }
+
+// Sync releases the locks of domains no longer in eligible or above the
+// member's share, and acquires free ones up to the share, as well as the
+// global lock if it is free. It reports whether the held domains changed.
+// The backend is only called without the mutex held, so Holds and CheckFence
+// do not wait for a Sync in progress.
+func (s *SiteLocks) Sync(ctx context.Context, eligible []string) (changed bool) {
+	want := map[string]bool{}
+	for _, d := range eligible {
+		want[d] = true
+	}
+	s.mu.Lock()
+	var drop []string
+	dropped := map[string]*Lock{}
+	for d, l := range s.held {
+		if l.isLost() {
+			s.logf("shard: lost lock of %s", d)
+		} else if !want[d] {
+			s.logf("shard: releasing %s, no longer selected", d)
+		} else {
+			continue
+		}
+		drop = append(drop, d)
+		dropped[d] = l
+		delete(s.held, d)
+	}
+	s.mu.Unlock()
+	s.releaseAll(drop, dropped)
+	changed = len(drop) > 0
+
+	s.syncGlobal(ctx)
+	if s.membership.isLost() {
+		// Rejoin, e.g. after the membership lease could not be renewed.
+		_ = s.membership.Release()
+		l, err := s.backend.TryAcquire(ctx, s.memberKey(), s.member)
+		if err != nil || l == nil {
+			s.logf("shard: rejoin group: not a member, keeping %d domain(s) only", len(s.Domains()))
+			return changed
+		}
+		s.mu.Lock()
+		s.membership = l
+		s.mu.Unlock()
+	}
+	members, err := s.backend.Count(ctx, s.memberPrefix())
+	if err != nil {
+		s.logf("shard: count members: %v", err)
+		return changed
+	}
+	members = max(members, 1)
+	share := (len(eligible) + members - 1) / members
+
+	s.mu.Lock()
+	drop, dropped = nil, map[string]*Lock{}
+	if len(s.held) > share {
+		// Hand the last domains over to members that joined.
+		for _, d := range s.domains()[share:] {
+			s.logf("shard: releasing %s to rebalance between %d member(s)", d, members)
+			drop = append(drop, d)
+			dropped[d] = s.held[d]
+			delete(s.held, d)
+		}
+	}
+	need := share - len(s.held)
+	var free []string
+	for _, d := range eligible {
+		if s.held[d] == nil {
+			free = append(free, d)
+		}
+	}
+	s.mu.Unlock()
+	s.releaseAll(drop, dropped)
+	changed = changed || len(drop) > 0
+
+	for _, d := range free {
+		if need <= 0 {
+			break
+		}
+		l, err := s.backend.TryAcquire(ctx, siteKey(d), s.member)
+		if err != nil {
+			s.logf("shard: acquire %s: %v", d, err)
+			continue
+		}
+		if l == nil {
+			continue
+		}
+		s.logf("shard: acquired %s (fencing token %d)", d, l.Token())
+		s.mu.Lock()
+		s.held[d] = l
+		s.mu.Unlock()
+		need--
+		changed = true
+	}
+	return changed
+}
+
+// syncGlobal acquires the global lock if it is not held, replacing a lost
+// one.
+func (s *SiteLocks) syncGlobal(ctx context.Context) {
+	s.mu.Lock()
+	cur := s.global
+	s.mu.Unlock()
+	if cur != nil && !cur.isLost() {
+		return
+	}
+	if cur != nil {
+		s.logf("shard: lost global lock")
+		_ = cur.Release()
+	}
+	l, err := s.backend.TryAcquire(ctx, globalKey, s.member)
+	if err != nil {
+		s.logf("shard: acquire global lock: %v", err)
+	}
+	if l != nil {
+		s.logf("shard: acquired global lock (fencing token %d)", l.Token())
+	}
+	s.mu.Lock()
+	s.global = l
+	s.mu.Unlock()
+}
+
+// Holds reports whether the member holds the lock of domain.
+func (s *SiteLocks) Holds(domain string) bool {
+	return s.lock(domain) != nil
+}
+
+// Domains returns the domains whose lock the member holds, sorted.
+func (s *SiteLocks) Domains() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.domains()
+}
+
+// Release releases every lock held, including the membership.
+func (s *SiteLocks) Release() error {
+	s.mu.Lock()
+	drop := s.domains()
+	dropped := s.held
+	global := s.global
+	s.held, s.global = map[string]*Lock{}, nil
+	s.mu.Unlock()
+	s.releaseAll(drop, dropped)
+	if global != nil {
+		if err := global.Release(); err != nil {
+			s.logf("shard: release global lock: %v", err)
+		}
+	}
+	return s.membership.Release()
+}
+
+func (s *SiteLocks) lock(domain string) *Lock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.held[domain]
+}
+
+func (s *SiteLocks) domains() []string {
+	domains := make([]string, 0, len(s.held))
+	for d := range s.held {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// globalLock returns the global lock if it is held.
+func (s *SiteLocks) globalLock() *Lock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.global
+}
+
+// releaseAll releases the locks of domains, which are no longer in held.
+func (s *SiteLocks) releaseAll(domains []string, locks map[string]*Lock) {
+	for _, d := range domains {
+		if err := locks[d].Release(); err != nil {
+			s.logf("shard: release %s: %v", d, err)
+		}
+	}
+}
+
+// globalKey names the lock of the shared files that are not specific to a
+// domain. It is shared by every group.
+const globalKey = "global"
+
+func siteKey(domain string) string { return "sites/" + domain }
+
+type siteLocksKey struct{}
+type siteKeyKey struct{}
+
+// WithSiteLocks returns a copy of ctx carrying s. Work on a domain is then
+// done under ForSite, and CheckFence checks the domain's lock.
+func WithSiteLocks(ctx context.Context, s *SiteLocks) context.Context {
+	return context.WithValue(ctx, siteLocksKey{}, s)
+}
+
+// ForSite returns a copy of ctx for work on the sites of domain.
+func ForSite(ctx context.Context, domain string) context.Context {
+	return context.WithValue(ctx, siteKeyKey{}, domain)
+}
+
+// Holds reports whether the shared storage of the sites of domain may be
+// written under ctx: when ctx carries a Leader, if its lock is held; under
+// site locks, if the domain's lock is; and otherwise always.
+func Holds(ctx context.Context, domain string) bool {
+	if ld, ok := ctx.Value(leaderKey{}).(*Leader); ok {
+		return ld.Lock() != nil
+	}
+	s, ok := ctx.Value(siteLocksKey{}).(*SiteLocks)
+	return !ok || s.Holds(domain)
+}
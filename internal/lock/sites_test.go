@@ -0,0 +1,112 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestSiteLocksShare(t *testing.T) {
+	tests := []struct {
+		name    string
+		domains int
+		members int
+		// want is the number of domains each member ends up with.
+		want []int
+	}{
+		{name: "single member", domains: 3, members: 1, want: []int{3}},
+		{name: "even split", domains: 4, members: 2, want: []int{2, 2}},
+		{name: "uneven split", domains: 5, members: 2, want: []int{3, 2}},
+		{name: "more members than domains", domains: 2, members: 3, want: []int{1, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := FileBackend{Dir: t.TempDir(), Options: Options{Logf: quiet}}
+			ctx := context.Background()
+			var eligible []string
+			for i := range tt.domains {
+				eligible = append(eligible, fmt.Sprintf("site%d.example.com", i))
+			}
+
+			// Members join one at a time; the first takes every domain.
+			var members []*SiteLocks
+			for i := range tt.members {
+				s, err := NewSiteLocks(ctx, b, "web", fmt.Sprintf("member%d", i), quiet)
+				if err != nil {
+					t.Fatalf("NewSiteLocks: %v", err)
+				}
+				defer s.Release()
+				members = append(members, s)
+				s.Sync(ctx, eligible)
+			}
+			// Members above their share hand domains over on their next
+			// sync, and the others pick them up on theirs.
+			for range 2 {
+				for _, s := range members {
+					s.Sync(ctx, eligible)
+				}
+			}
+
+			owner := map[string]string{}
+			globals := 0
+			for i, s := range members {
+				if got := len(s.Domains()); got != tt.want[i] {
+					t.Errorf("member%d holds %d domain(s), want %d", i, got, tt.want[i])
+				}
+				for _, d := range s.Domains() {
+					if prev, ok := owner[d]; ok {
+						t.Errorf("%s held by both %s and member%d", d, prev, i)
+					}
+					owner[d] = fmt.Sprintf("member%d", i)
+				}
+				if s.globalLock() != nil {
+					globals++
+				}
+			}
+			if len(owner) != tt.domains {
+				t.Errorf("%d of %d domains held", len(owner), tt.domains)
+			}
+			if globals != 1 {
+				t.Errorf("global lock held by %d member(s), want 1", globals)
+			}
+		})
+	}
+}
+
+func TestSiteLocksReleaseUnselected(t *testing.T) {
+	b := FileBackend{Dir: t.TempDir(), Options: Options{Logf: quiet}}
+	ctx := context.Background()
+	s, err := NewSiteLocks(ctx, b, "web", "member0", quiet)
+	if err != nil {
+		t.Fatalf("NewSiteLocks: %v", err)
+	}
+	defer s.Release()
+	if _, err := NewSiteLocks(ctx, b, "web", "member0", quiet); err == nil {
+		t.Error("member joined twice")
+	}
+
+	if changed := s.Sync(ctx, []string{"a.example.com", "b.example.com"}); !changed {
+		t.Error("first Sync reported no change")
+	}
+	if changed := s.Sync(ctx, []string{"a.example.com", "b.example.com"}); changed {
+		t.Error("Sync without changes reported a change")
+	}
+	s.Sync(ctx, []string{"a.example.com"})
+	if got := s.Domains(); len(got) != 1 || got[0] != "a.example.com" {
+		t.Errorf("domains after deselecting b.example.com = %v", got)
+	}
+	if held, err := Probe(b.path(siteKey("b.example.com"))); err != nil || held {
+		t.Errorf("lock of b.example.com still held: %v, %v", held, err)
+	}
+
+	ctx = WithSiteLocks(ctx, s)
+	if !Holds(ctx, "a.example.com") || Holds(ctx, "b.example.com") {
+		t.Error("Holds does not match the domains held")
+	}
+	if err := CheckFence(ForSite(ctx, "a.example.com")); err != nil {
+		t.Errorf("CheckFence of a held domain: %v", err)
+	}
+	if err := CheckFence(ForSite(ctx, "b.example.com")); err == nil {
+		t.Error("CheckFence of a released domain succeeded")
+	}
+}
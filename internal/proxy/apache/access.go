@@ -0,0 +1,76 @@
+package apache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// htpasswdPath returns where the basic-auth users of a site are stored. It is
+// outside every document root so it can never be downloaded.
+func (m *ApacheManager) htpasswdPath(site cfg.Site) string {
+	return filepath.Join(m.stateDir(), "htpasswd", site.ID())
+}
+
+// syncHtpasswd writes the htpasswd file of a site with basic-auth users, and
+// removes any leftover file otherwise. Plaintext passwords are hashed with
+// bcrypt; an existing hash is kept while it still matches the password, so
+// the file only changes when the users do.
+func (m *ApacheManager) syncHtpasswd(site cfg.Site) error {
+	path := m.htpasswdPath(site)
+	if site.Access == nil || len(site.Access.Users) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("remove htpasswd: %w", err)
+		}
+		return nil
+	}
+
+	existing := readHtpasswd(path)
+	var buf bytes.Buffer
+	for _, u := range site.Access.Users {
+		hash := u.PasswordHash
+		if hash == "" {
+			hash = existing[u.Username]
+			if bcrypt.CompareHashAndPassword([]byte(hash), []byte(u.Password)) != nil {
+				h, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+				if err != nil {
+					return fmt.Errorf("hash password of %s: %w", u.Username, err)
+				}
+				hash = string(h)
+			}
+		}
+		fmt.Fprintf(&buf, "%s:%s\n", u.Username, hash)
+	}
+
+	if err := writeFile(path, buf.Bytes(), 0o640); err != nil {
+		return fmt.Errorf("write htpasswd: %w", err)
+	}
+	return nil
+}
+
+// readHtpasswd returns the hashes in an htpasswd file keyed by user. A missing
+// or unreadable file yields an empty map.
+func readHtpasswd(path string) map[string]string {
+	hashes := map[string]string{}
+	f, err := os.Open(path)
+	if err != nil {
+		return hashes
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if user, hash, ok := strings.Cut(sc.Text(), ":"); ok {
+			hashes[user] = hash
+		}
+	}
+	return hashes
+}
@@ -1,41 +1,252 @@
 package apache
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/eryalito/multi-wordpress-file-manager/internal/certs"
+	"github.com/eryalito/multi-wordpress-file-manager/internal/fpm"
+	"github.com/eryalito/multi-wordpress-file-manager/internal/proxy"
 	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
 )
 
+// DefaultHTTPSPort is the port TLS vhosts listen on when none is configured.
+// It matches the unprivileged Listen directive set up in the container image.
+const DefaultHTTPSPort = 8443
+
+// Apache reads the vhosts linked from sitesEnabled to sitesAvailable.
+const (
+	sitesAvailable = "/etc/apache2/sites-available"
+	sitesEnabled   = "/etc/apache2/sites-enabled"
+)
+
+// managedHeader starts the vhosts rendered by Configure, telling them apart
+// from the others in sitesAvailable.
+const managedHeader = "# Managed by mwpfm; removed once the domain is no longer configured.\n"
+
+// DefaultStateDir is the StateDir used when none is configured. In the chart
+// it is a volume local to the pod, shared by Apache and the controller.
+const DefaultStateDir = "/var/lib/mwpfm"
+
 // ApacheManager configures Apache virtual hosts.
-type ApacheManager struct{}
+type ApacheManager struct {
+	// HTTPSPort is the port used for TLS vhosts; DefaultHTTPSPort if zero.
+	HTTPSPort int
+	// ACMEChallengeDir holds HTTP-01 challenge responses for sites in
+	// "acme" TLS mode.
+	ACMEChallengeDir string
+	// StateDir is where files referenced by the vhosts, such as maintenance
+	// pages, htpasswd files and the page cache, are written;
+	// DefaultStateDir if empty. It must be local to the Apache instance, as
+	// every replica writes it on each run.
+	StateDir string
+	// SecurityHeaders and Hardening are the defaults for sites that do not
+	// override them.
+	SecurityHeaders cfg.SecurityHeaders
+	Hardening       bool
+	// Logging is the default logging of sites that do not override it.
+	Logging cfg.Logging
+	// FPM, when set, has PHP requests proxied to each site's PHP-FPM pool
+	// instead of being handled by mod_php.
+	FPM *fpm.Manager
+}
+
+// Configure creates a virtual host configuration file for a site. When the
+// site has TLS configured, the certificate is validated first and an HTTPS
+// vhost is rendered together with a plain HTTP vhost redirecting to it. Sites
+// in "acme" TLS mode whose certificate has not been issued yet are served
+// over plain HTTP only, so the challenges can be answered. Sites in
+// maintenance mode answer 503 with a maintenance page, except to allowed IPs.
+// Access restrictions are rendered as Require rules, with basic-auth users
+// kept in an htpasswd file outside the document root. Security headers and
+// the hardening rules come from the manager defaults unless the site
+// overrides them. PHP settings are rendered as php_admin_value lines unless
+// the site runs in a PHP-FPM pool, which carries them itself. Sites with the
+// page cache enabled get mod_cache_disk directives caching anonymous traffic.
+// Mounted sites are served from their own directory through an Alias at
+// their path prefix, with their own access rules and PHP handling.
+func (m *ApacheManager) Configure(site cfg.Site, sitePath string, mounts ...proxy.Mount) error {
+	data, err := m.siteData(site, sitePath, mounts)
+	if err != nil {
+		return err
+	}
+	vhostConfig, err := renderVHost(data)
+	if err != nil {
+		return fmt.Errorf("render vhost: %w", err)
+	}
+
+	configPath := filepath.Join(sitesAvailable, site.DomainName+".conf")
+	return os.WriteFile(configPath, vhostConfig, 0644)
+}
+
+// siteData prepares the template input of a site and its mounts, writing the
+// files its vhost refers to along the way.
+func (m *ApacheManager) siteData(site cfg.Site, sitePath string, mounts []proxy.Mount) (vhostData, error) {
+	data := vhostData{
+		Site:      site,
+		HTTPSPort: m.HTTPSPort,
+		Headers:   securityHeaders(m.SecurityHeaders.Merge(site.SecurityHeaders)),
+		Hardening: m.Hardening,
+		Logs:      logging(site, m.Logging.Merge(site.Logging)),
+	}
+	if site.Hardening != nil {
+		data.Hardening = *site.Hardening
+	}
+	if data.HTTPSPort == 0 {
+		data.HTTPSPort = DefaultHTTPSPort
+	}
+	if site.TLS != nil && site.TLS.Mode == cfg.TLSModeACME {
+		data.ChallengeDir = m.ACMEChallengeDir
+	}
+	if site.TLS != nil && !pendingACME(site.TLS) {
+		certFile, keyFile, err := certs.Files(*site.TLS)
+		if err != nil {
+			return data, err
+		}
+		if err := certs.Validate(certFile, keyFile, site.Hostnames()); err != nil {
+			return data, fmt.Errorf("invalid certificate for %s: %w", site.DomainName, err)
+		}
+		data.CertFile, data.KeyFile = certFile, keyFile
+	}
+
+	if err := m.syncMaintenancePage(site); err != nil {
+		return data, err
+	}
+	for _, mnt := range append([]proxy.Mount{{Site: site, Path: sitePath}}, mounts...) {
+		md, err := m.mountData(mnt)
+		if err != nil {
+			return data, err
+		}
+		data.Mounts = append(data.Mounts, md)
+	}
+	cache, err := m.cache(site, data.Mounts)
+	if err != nil {
+		return data, err
+	}
+	data.Cache = cache
+	if site.Maintenance != nil && site.Maintenance.Enabled {
+		data.MaintenancePage = m.maintenancePath(site)
+		data.MaintenanceURI = maintenanceURI
+		data.RetryAfter = site.Maintenance.RetryAfter
+		if data.RetryAfter == 0 {
+			data.RetryAfter = defaultMaintenanceRetryAfter
+		}
+	}
+	return data, nil
+}
 
-// Configure creates a virtual host configuration file for a site.
-func (m *ApacheManager) Configure(site cfg.Site, sitePath string) error {
-	vhostConfig := fmt.Sprintf(`
-<VirtualHost *>
-    ServerName %s
-    DocumentRoot %s
+// mountData prepares the template input of a site served by a vhost.
+func (m *ApacheManager) mountData(mnt proxy.Mount) (mount, error) {
+	md := mount{Site: mnt.Site, Path: mnt.Path}
+	if m.FPM != nil {
+		md.FPMSocket = m.FPM.SocketPath(mnt.Site)
+	} else {
+		md.PHPSettings = fpm.Settings(mnt.Site)
+	}
+	if err := m.syncHtpasswd(mnt.Site); err != nil {
+		return md, err
+	}
+	if a := mnt.Site.Access; a != nil && len(a.Users) > 0 {
+		md.HtpasswdFile = m.htpasswdPath(mnt.Site)
+	}
+	return md, nil
+}
 
-    <Directory %s>
-        Options Indexes SymLinksIfOwnerMatch
-        AllowOverride All
-        Require all granted
-    </Directory>
+// stateDir returns the directory of the files referenced by the vhosts.
+func (m *ApacheManager) stateDir() string {
+	if m.StateDir == "" {
+		return DefaultStateDir
+	}
+	return m.StateDir
+}
 
-    ErrorLog ${APACHE_LOG_DIR}/%s_error.log
-    CustomLog ${APACHE_LOG_DIR}/%s_access.log combined
-</VirtualHost>
-`, site.DomainName, sitePath, sitePath, site.DomainName, site.DomainName)
+// writeFile writes data to path unless it already holds it. The file is
+// written next to its target and renamed over it, so Apache never reads it
+// half written.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
 
-	configPath := fmt.Sprintf("/etc/apache2/sites-available/%s.conf", site.DomainName)
-	return os.WriteFile(configPath, []byte(vhostConfig), 0644)
+func pendingACME(t *cfg.TLS) bool {
+	return t.Mode == cfg.TLSModeACME && t.CertFile == ""
 }
 
 // Enable enables the site by creating a symlink.
 func (m *ApacheManager) Enable(site cfg.Site) error {
-	src := fmt.Sprintf("/etc/apache2/sites-available/%s.conf", site.DomainName)
-	dest := fmt.Sprintf("/etc/apache2/sites-enabled/%s.conf", site.DomainName)
+	return enable(site.DomainName)
+}
+
+// Prune disables and removes the vhosts of domains that are no longer
+// configured. Only vhosts rendered by Configure are touched.
+func (m *ApacheManager) Prune(sites []cfg.Site) error {
+	keep := map[string]bool{}
+	for _, site := range sites {
+		keep[site.DomainName+".conf"] = true
+	}
+	return pruneVHosts(sitesAvailable, sitesEnabled, keep)
+}
+
+// pruneVHosts removes the managed vhosts in available whose file name is not
+// in keep, together with their links in enabled.
+func pruneVHosts(available, enabled string, keep map[string]bool) error {
+	entries, err := os.ReadDir(available)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read vhost dir: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if keep[name] || !strings.HasSuffix(name, ".conf") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(available, name))
+		if err != nil || !bytes.HasPrefix(content, []byte(managedHeader)) {
+			continue
+		}
+		for _, path := range []string{filepath.Join(enabled, name), filepath.Join(available, name)} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("remove stale vhost %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// enable links the named configuration from sites-available into
+// sites-enabled, replacing any existing link.
+func enable(name string) error {
+	src := filepath.Join(sitesAvailable, name+".conf")
+	dest := filepath.Join(sitesEnabled, name+".conf")
 
 	// a2ensite command is just a symlink, so we can do it directly
 	if _, err := os.Lstat(dest); err == nil {
@@ -0,0 +1,38 @@
+package apache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPruneVHosts(t *testing.T) {
+	available, enabled := t.TempDir(), t.TempDir()
+	vhosts := map[string]string{
+		"kept.example.com.conf":    managedHeader + "<VirtualHost *:8080>\n",
+		"removed.example.com.conf": managedHeader + "<VirtualHost *:8080>\n",
+		"000-default.conf":         "<VirtualHost *:8080>\n",
+		"custom.conf":              "# Installed by hand\n",
+	}
+	for name, content := range vhosts {
+		if err := os.WriteFile(filepath.Join(available, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join(available, name), filepath.Join(enabled, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneVHosts(available, enabled, map[string]bool{"kept.example.com.conf": true}); err != nil {
+		t.Fatalf("pruneVHosts: %v", err)
+	}
+	for name := range vhosts {
+		want := name != "removed.example.com.conf"
+		for _, dir := range []string{available, enabled} {
+			_, err := os.Lstat(filepath.Join(dir, name))
+			if exists := err == nil; exists != want {
+				t.Errorf("%s: exists = %v, want %v", filepath.Join(dir, name), exists, want)
+			}
+		}
+	}
+}
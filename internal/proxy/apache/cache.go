@@ -0,0 +1,83 @@
+package apache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+const defaultCacheTTL = 300
+
+// Paths and cookie name prefixes that always bypass the page cache.
+var (
+	cacheBypassPaths   = []string{"/wp-admin", "/wp-login.php", "/wp-cron.php", "/xmlrpc.php"}
+	cacheBypassCookies = []string{"wordpress_logged_in_", "wordpress_sec_", "wp-postpass_", "comment_author_", "woocommerce_items_in_cart"}
+)
+
+// cacheDirectives is the page cache configuration of a vhost.
+type cacheDirectives struct {
+	Root        string
+	TTL         int
+	BypassPaths []string
+	// CookiePattern matches Cookie headers of requests that must bypass the
+	// cache.
+	CookiePattern string
+}
+
+// cacheDir returns where the page cache of a site is stored.
+func (m *ApacheManager) cacheDir(site cfg.Site) string {
+	return filepath.Join(m.stateDir(), "cache", site.DomainName)
+}
+
+// cache returns the page cache directives of a site, or nil when caching is
+// off. The built-in bypass paths apply to every mount of the vhost. The cache
+// directory is created if needed.
+func (m *ApacheManager) cache(site cfg.Site, mounts []mount) (*cacheDirectives, error) {
+	c := site.Cache
+	if c == nil || !c.Enabled {
+		return nil, nil
+	}
+	d := &cacheDirectives{
+		Root: m.cacheDir(site),
+		TTL:  c.TTL,
+	}
+	for _, mnt := range mounts {
+		for _, p := range cacheBypassPaths {
+			d.BypassPaths = append(d.BypassPaths, mnt.Site.PathPrefix+p)
+		}
+	}
+	d.BypassPaths = append(d.BypassPaths, c.BypassPaths...)
+	if d.TTL == 0 {
+		d.TTL = defaultCacheTTL
+	}
+	cookies := append(append([]string{}, cacheBypassCookies...), c.BypassCookies...)
+	d.CookiePattern = `(^|;\s*)(` + strings.Join(cookies, "|") + `)`
+	if err := os.MkdirAll(d.Root, 0o755); err != nil {
+		return nil, fmt.Errorf("create cache directory: %w", err)
+	}
+	return d, nil
+}
+
+// PurgeCache empties the page cache of a site. Apache repopulates it on the
+// next requests.
+func (m *ApacheManager) PurgeCache(site cfg.Site) error {
+	dir := m.cacheDir(site)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read cache directory: %w", err)
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return fmt.Errorf("purge cache: %w", err)
+		}
+	}
+	return nil
+}
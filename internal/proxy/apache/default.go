@@ -0,0 +1,99 @@
+package apache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/eryalito/multi-wordpress-file-manager/internal/proxy"
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+const (
+	// defaultName sorts before every site so Apache uses it as the catch-all.
+	defaultName = "000-default"
+	// defaultPageName is the custom page served by the catch-all in deny mode.
+	defaultPageName = ".mwpfm-default.html"
+)
+
+// defaultData is the input of the "default" template.
+type defaultData struct {
+	Action string
+	// Target is the redirect URL in redirect mode.
+	Target string
+	// DocumentRoot and Page are used in deny mode; Page is empty when the
+	// built-in message is returned.
+	DocumentRoot string
+	Page         string
+}
+
+// ConfigureDefault renders the catch-all vhost. In deny mode it answers 403
+// with the custom page, or a built-in message when there is none. In redirect
+// mode every request is redirected to the target URL, and in serve mode the
+// given site answers for every unknown host.
+func (m *ApacheManager) ConfigureDefault(def cfg.DefaultSite, serve *cfg.Site, servePath string, mounts ...proxy.Mount) error {
+	action, arg := def.Action()
+	docRoot := filepath.Join(m.stateDir(), "default")
+	if err := syncDefaultPage(docRoot, def.Page, action); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	switch action {
+	case cfg.DefaultSiteServe:
+		if serve == nil {
+			return fmt.Errorf("default site %s is not configured", arg)
+		}
+		// The catch-all only answers plain HTTP; the site's own vhost keeps
+		// handling TLS for its names.
+		site := *serve
+		site.TLS = nil
+		data, err := m.siteData(site, servePath, mounts)
+		if err != nil {
+			return err
+		}
+		data.Default = true
+		if err := vhostTemplate.Execute(&buf, data); err != nil {
+			return fmt.Errorf("render default vhost: %w", err)
+		}
+	default:
+		data := defaultData{Action: action, Target: arg, DocumentRoot: docRoot}
+		if def.Page != "" {
+			data.Page = defaultPageName
+		}
+		if err := vhostTemplate.ExecuteTemplate(&buf, "default", data); err != nil {
+			return fmt.Errorf("render default vhost: %w", err)
+		}
+	}
+
+	configPath := filepath.Join(sitesAvailable, defaultName+".conf")
+	return os.WriteFile(configPath, buf.Bytes(), 0644)
+}
+
+// EnableDefault enables the catch-all vhost.
+func (m *ApacheManager) EnableDefault() error {
+	return enable(defaultName)
+}
+
+// syncDefaultPage writes the custom page of the catch-all in deny mode, and
+// removes any leftover page otherwise. The document root is always created
+// so Apache can start with it.
+func syncDefaultPage(docRoot, page, action string) error {
+	if err := os.MkdirAll(docRoot, 0o755); err != nil {
+		return fmt.Errorf("create default document root: %w", err)
+	}
+	path := filepath.Join(docRoot, defaultPageName)
+	if page == "" || action != cfg.DefaultSiteDeny {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("remove default page: %w", err)
+		}
+		return nil
+	}
+	if err := writeFile(path, []byte(page), 0o644); err != nil {
+		return fmt.Errorf("write default page: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package apache
+
+import (
+	"fmt"
+	"strings"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// header is a response header set on every response of a vhost.
+type header struct {
+	Name, Value string
+}
+
+// Quoted returns the header value as a quoted Apache argument.
+func (h header) Quoted() string {
+	return `"` + strings.ReplaceAll(h.Value, `"`, `\"`) + `"`
+}
+
+// securityHeaders returns the headers to send for h, in a stable order.
+func securityHeaders(h cfg.SecurityHeaders) []header {
+	var headers []header
+	if h.HSTS != nil {
+		v := fmt.Sprintf("max-age=%d", h.HSTS.MaxAge)
+		if h.HSTS.IncludeSubdomains {
+			v += "; includeSubDomains"
+		}
+		if h.HSTS.Preload {
+			v += "; preload"
+		}
+		headers = append(headers, header{"Strict-Transport-Security", v})
+	}
+	if h.FrameOptions != "" {
+		headers = append(headers, header{"X-Frame-Options", strings.ToUpper(h.FrameOptions)})
+	}
+	if h.ContentSecurityPolicy != "" {
+		headers = append(headers, header{"Content-Security-Policy", h.ContentSecurityPolicy})
+	}
+	if h.ReferrerPolicy != "" {
+		headers = append(headers, header{"Referrer-Policy", h.ReferrerPolicy})
+	}
+	if h.PermissionsPolicy != "" {
+		headers = append(headers, header{"Permissions-Policy", h.PermissionsPolicy})
+	}
+	return headers
+}
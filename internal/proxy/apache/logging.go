@@ -0,0 +1,85 @@
+package apache
+
+import (
+	"fmt"
+	"path/filepath"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+const (
+	defaultLogDir   = "${APACHE_LOG_DIR}"
+	defaultRotation = "86400"
+	rotatelogsPath  = "/usr/bin/rotatelogs"
+
+	// jsonLogFormat is the nickname of the JSON access log format. Every
+	// entry carries the vhost's domain so shared streams can be split per site.
+	// Apache escapes " and \ in logged values with a backslash, as JSON does,
+	// but control and non-ASCII bytes as \xhh, which JSON rejects. The format
+	// therefore logs no field that can carry such bytes: the request target is
+	// logged as the client sent it, still percent-encoded, instead of the
+	// decoded %U, and the Host, Referer and User-Agent headers percent-encoded
+	// by jsonLogRewrite.
+	jsonLogFormat       = "mwpfm_json"
+	jsonLogFormatString = `"{\"time\":\"%{%Y-%m-%dT%H:%M:%S%z}t\",\"domain\":\"%v\",\"host\":\"%{MWPFM_LOG_HOST}e\",` +
+		`\"remote_addr\":\"%a\",\"method\":\"%m\",\"uri\":\"%{MWPFM_LOG_TARGET}e\",\"protocol\":\"%H\",\"status\":%>s,` +
+		`\"bytes\":%B,\"duration_us\":%D,\"referer\":\"%{MWPFM_LOG_REFERER}e\",\"user_agent\":\"%{MWPFM_LOG_USER_AGENT}e\"}"`
+)
+
+// jsonLogRewrite sets the variables the JSON format logs. The rules come
+// before any other rewrite rule of the vhost, which could end rewriting
+// first; int:escape percent-encodes everything but URL-safe ASCII.
+var jsonLogRewrite = []string{
+	"RewriteEngine On",
+	"RewriteMap mwpfm_escape int:escape",
+	`RewriteCond %{THE_REQUEST} ^\S+\s+(\S+)`,
+	"RewriteRule ^ - [E=MWPFM_LOG_TARGET:%1]",
+	"RewriteRule ^ - [E=MWPFM_LOG_HOST:${mwpfm_escape:%{HTTP_HOST}},E=MWPFM_LOG_REFERER:${mwpfm_escape:%{HTTP_REFERER}},E=MWPFM_LOG_USER_AGENT:${mwpfm_escape:%{HTTP_USER_AGENT}}]",
+}
+
+// logDirectives holds the rendered logging directives of a vhost.
+type logDirectives struct {
+	// LogFormat defines the JSON format when it is used, and Rewrite the
+	// rules setting the variables it logs.
+	LogFormat string
+	Rewrite   []string
+	ErrorLog  string
+	CustomLog string
+}
+
+// logging returns the log directives of a site for the given settings.
+func logging(site cfg.Site, l cfg.Logging) logDirectives {
+	var d logDirectives
+	format := "combined"
+	if l.Format == cfg.LogFormatJSON {
+		d.LogFormat = jsonLogFormatString + " " + jsonLogFormat
+		d.Rewrite = jsonLogRewrite
+		format = jsonLogFormat
+	}
+	dir := l.Dir
+	if dir == "" {
+		dir = defaultLogDir
+	}
+	errorFile := filepath.Join(dir, site.DomainName+"_error.log")
+	accessFile := filepath.Join(dir, site.DomainName+"_access.log")
+
+	switch l.Target {
+	case cfg.LogTargetStdout:
+		d.ErrorLog = "/proc/self/fd/2"
+		d.CustomLog = "/proc/self/fd/1 " + format
+	case cfg.LogTargetStderr:
+		d.ErrorLog = "/proc/self/fd/2"
+		d.CustomLog = "/proc/self/fd/2 " + format
+	case cfg.LogTargetRotatelogs:
+		rotation := l.Rotation
+		if rotation == "" {
+			rotation = defaultRotation
+		}
+		d.ErrorLog = fmt.Sprintf(`"|%s -l %s.%%Y-%%m-%%d %s"`, rotatelogsPath, errorFile, rotation)
+		d.CustomLog = fmt.Sprintf(`"|%s -l %s.%%Y-%%m-%%d %s" %s`, rotatelogsPath, accessFile, rotation, format)
+	default:
+		d.ErrorLog = errorFile
+		d.CustomLog = accessFile + " " + format
+	}
+	return d
+}
@@ -0,0 +1,117 @@
+package apache
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// renderJSONVHost renders the vhost of a site logging in JSON, with rewrite
+// rules of its own.
+func renderJSONVHost(t *testing.T) string {
+	t.Helper()
+	site := cfg.Site{
+		DomainName:  "site1.example.com",
+		Maintenance: &cfg.Maintenance{Enabled: true},
+		Redirects:   []cfg.Redirect{{Source: "/old", Target: "/new"}},
+	}
+	data := vhostData{
+		Site:            site,
+		Mounts:          []mount{{Site: site, Path: "/var/www/html/site1.example.com"}},
+		Logs:            logging(site, cfg.Logging{Target: cfg.LogTargetStdout, Format: cfg.LogFormatJSON}),
+		MaintenancePage: "/var/lib/mwpfm/maintenance/site1.example.com.html",
+		MaintenanceURI:  maintenanceURI,
+		RetryAfter:      300,
+	}
+	out, err := renderVHost(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+// logFormat returns the format string of the rendered LogFormat directive as
+// Apache reads it: unquoted, with \" unescaped.
+func logFormat(t *testing.T, vhost string) string {
+	t.Helper()
+	for _, line := range strings.Split(vhost, "\n") {
+		arg, ok := strings.CutPrefix(strings.TrimSpace(line), "LogFormat ")
+		if !ok {
+			continue
+		}
+		arg, ok = strings.CutSuffix(arg, " "+jsonLogFormat)
+		if !ok || len(arg) < 2 || arg[0] != '"' || arg[len(arg)-1] != '"' {
+			t.Fatalf("unexpected LogFormat directive: %s", line)
+		}
+		return strings.ReplaceAll(arg[1:len(arg)-1], `\"`, `"`)
+	}
+	t.Fatal("no LogFormat directive rendered")
+	return ""
+}
+
+func TestJSONLogRulesComeFirst(t *testing.T) {
+	vhost := renderJSONVHost(t)
+	capture := strings.Index(vhost, "E=MWPFM_LOG_USER_AGENT:")
+	if capture < 0 {
+		t.Fatal("log field rules not rendered")
+	}
+	if first := strings.Index(vhost, "RewriteRule ^ - [R=503,L]"); first < 0 || first < capture {
+		t.Errorf("maintenance rule rendered before the log field rules:\n%s", vhost)
+	}
+	if first := strings.Index(vhost, "RewriteRule ^/old$ /new"); first < 0 || first < capture {
+		t.Errorf("redirect rendered before the log field rules:\n%s", vhost)
+	}
+}
+
+// logDirective matches the directives of a LogFormat string.
+var logDirective = regexp.MustCompile(`%[<>]?(\{[^}]*\})?[a-zA-Z]`)
+
+func TestJSONLogFormat(t *testing.T) {
+	// What Apache logs for each directive of a GET /café?q="x" request, sent
+	// percent-encoded as clients do, with a non-ASCII User-Agent. The
+	// variables hold the request target as sent and the headers as encoded
+	// by int:escape; Apache then escapes " and \ with a backslash.
+	values := map[string]string{
+		"%{%Y-%m-%dT%H:%M:%S%z}t":  "2024-01-02T03:04:05+0000",
+		"%v":                       "site1.example.com",
+		"%{MWPFM_LOG_HOST}e":       "site1.example.com",
+		"%a":                       "192.0.2.1",
+		"%m":                       "GET",
+		"%{MWPFM_LOG_TARGET}e":     `/caf%C3%A9?q=\"x\"`,
+		"%H":                       "HTTP/1.1",
+		"%>s":                      "200",
+		"%B":                       "512",
+		"%D":                       "1500",
+		"%{MWPFM_LOG_REFERER}e":    "https://example.com/%3Fa=%22b%22",
+		"%{MWPFM_LOG_USER_AGENT}e": "Mozilla/5.0%20(%C3%A9)%20%5C",
+	}
+	format := logFormat(t, renderJSONVHost(t))
+	line := logDirective.ReplaceAllStringFunc(format, func(d string) string {
+		v, ok := values[d]
+		if !ok {
+			// e.g. %U or %{User-Agent}i, which can carry raw bytes
+			t.Errorf("format logs %s, which may not be valid JSON", d)
+		}
+		return v
+	})
+
+	want := `{"time":"2024-01-02T03:04:05+0000","domain":"site1.example.com","host":"site1.example.com",` +
+		`"remote_addr":"192.0.2.1","method":"GET","uri":"/caf%C3%A9?q=\"x\"","protocol":"HTTP/1.1","status":200,` +
+		`"bytes":512,"duration_us":1500,"referer":"https://example.com/%3Fa=%22b%22","user_agent":"Mozilla/5.0%20(%C3%A9)%20%5C"}`
+	if line != want {
+		t.Errorf("log entry\n got: %s\nwant: %s", line, want)
+	}
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("entry is not valid JSON: %v\n%s", err, line)
+	}
+	if entry["uri"] != `/caf%C3%A9?q="x"` {
+		t.Errorf("uri = %q", entry["uri"])
+	}
+	if entry["status"] != float64(200) {
+		t.Errorf("status = %v", entry["status"])
+	}
+}
@@ -0,0 +1,64 @@
+package apache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+const (
+	// maintenanceURI is the path the maintenance page is served at.
+	maintenanceURI = "/.mwpfm-maintenance.html"
+
+	defaultMaintenanceMessage    = "This site is undergoing scheduled maintenance. Please check back soon."
+	defaultMaintenanceRetryAfter = 600
+)
+
+var maintenancePage = template.Must(template.New("maintenance").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <title>{{ .Domain }} - Maintenance</title>
+</head>
+<body>
+    <h1>Down for maintenance</h1>
+    <p>{{ .Message }}</p>
+</body>
+</html>
+`))
+
+// maintenancePath returns where the maintenance page of a site is stored.
+func (m *ApacheManager) maintenancePath(site cfg.Site) string {
+	return filepath.Join(m.stateDir(), "maintenance", site.DomainName+".html")
+}
+
+// syncMaintenancePage writes the maintenance page of a site in maintenance
+// mode, and removes any leftover page otherwise.
+func (m *ApacheManager) syncMaintenancePage(site cfg.Site) error {
+	path := m.maintenancePath(site)
+	if site.Maintenance == nil || !site.Maintenance.Enabled {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("remove maintenance page: %w", err)
+		}
+		return nil
+	}
+
+	msg := site.Maintenance.Message
+	if msg == "" {
+		msg = defaultMaintenanceMessage
+	}
+	var buf bytes.Buffer
+	if err := maintenancePage.Execute(&buf, struct{ Domain, Message string }{site.DomainName, msg}); err != nil {
+		return fmt.Errorf("render maintenance page: %w", err)
+	}
+	if err := writeFile(path, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("write maintenance page: %w", err)
+	}
+	return nil
+}
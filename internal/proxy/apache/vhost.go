@@ -0,0 +1,372 @@
+package apache
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"text/template"
+
+	"github.com/eryalito/multi-wordpress-file-manager/internal/fpm"
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// emptyDocumentRoot is the document root of domains whose sites are all
+// mounted under a path prefix. It is created in the container image.
+const emptyDocumentRoot = "/var/www/empty"
+
+// vhostData is the input of vhostTemplate.
+type vhostData struct {
+	// Site is the domain's primary site, which the vhost-wide settings are
+	// taken from.
+	Site      cfg.Site
+	HTTPSPort int
+	CertFile  string
+	KeyFile   string
+	// ChallengeDir is served at /.well-known/acme-challenge/ over plain HTTP.
+	ChallengeDir string
+	// MaintenancePage is set when the site is in maintenance mode.
+	MaintenancePage string
+	MaintenanceURI  string
+	RetryAfter      int
+	// Mounts are the sites served by the vhost, the primary site first.
+	Mounts    []mount
+	Headers   []header
+	Hardening bool
+	Logs      logDirectives
+	// Cache is set when the site has the page cache enabled.
+	Cache *cacheDirectives
+	// Default renders the site as the catch-all vhost.
+	Default bool
+}
+
+// mount is a site served by a vhost from its own directory.
+type mount struct {
+	Site cfg.Site
+	Path string
+	// HtpasswdFile is set when the site has basic-auth users.
+	HtpasswdFile string
+	// FPMSocket is set when PHP is handled by the site's PHP-FPM pool.
+	FPMSocket string
+	// PHPSettings are applied through mod_php; with PHP-FPM they are part of
+	// the pool configuration instead.
+	PHPSettings []fpm.Setting
+}
+
+// Access returns the site's access restrictions, or nil.
+func (m mount) Access() *cfg.Access { return m.Site.Access }
+
+func (d vhostData) TLS() bool { return d.CertFile != "" }
+
+// Aliases returns the names the vhost answers to besides the domain name,
+// including those of a multisite network.
+func (d vhostData) Aliases() []string { return d.Site.Hostnames()[1:] }
+
+// HasRoot reports whether a site is served at the root of the domain.
+func (d vhostData) HasRoot() bool {
+	return len(d.Mounts) > 0 && d.Mounts[0].Site.PathPrefix == ""
+}
+
+// DocumentRoot returns the directory of the site served at the root of the
+// domain, or an empty directory when there is none.
+func (d vhostData) DocumentRoot() string {
+	if d.HasRoot() {
+		return d.Mounts[0].Path
+	}
+	return emptyDocumentRoot
+}
+
+func (d vhostData) MaintenanceDir() string { return filepath.Dir(d.MaintenancePage) }
+
+// rewriteRule is a RewriteRule line of the vhost.
+type rewriteRule struct {
+	Pattern, Substitution, Flags string
+}
+
+// Redirects returns the site's redirects as rewrite rules. Exact sources are
+// anchored and escaped; regular expressions are used as written.
+func (d vhostData) Redirects() []rewriteRule {
+	rules := make([]rewriteRule, 0, len(d.Site.Redirects))
+	for _, rd := range d.Site.Redirects {
+		pattern := rd.Source
+		if !rd.Regex {
+			pattern = "^" + regexp.QuoteMeta(rd.Source) + "$"
+		}
+		status := rd.Status
+		if status == 0 {
+			status = 301
+		}
+		rules = append(rules, rewriteRule{pattern, rd.Target, fmt.Sprintf("R=%d,L", status)})
+	}
+	return rules
+}
+
+// AllowIPs returns the addresses that bypass maintenance mode.
+func (d vhostData) AllowIPs() []string {
+	if d.Site.Maintenance == nil {
+		return nil
+	}
+	return d.Site.Maintenance.AllowIPs
+}
+
+var vhostTemplate = template.Must(template.New("vhost").Parse(`
+{{- define "names" }}
+{{- if .Default }}
+    ServerName default
+{{- else }}
+    ServerName {{ .Site.DomainName }}
+{{- range .Aliases }}
+    ServerAlias {{ . }}
+{{- end }}
+{{- end }}
+{{- end }}
+
+{{- define "default" }}
+<VirtualHost *>
+    ServerName default
+{{- if eq .Action "redirect" }}
+
+    RewriteEngine On
+    RewriteRule ^ {{ .Target }} [R=302,L]
+{{- else }}
+    DocumentRoot {{ .DocumentRoot }}
+
+    # Deny all access
+    <Directory {{ .DocumentRoot }}>
+        Require all denied
+{{- if .Page }}
+        <Files "{{ .Page }}">
+            Require all granted
+        </Files>
+{{- end }}
+    </Directory>
+
+    # Return 403 for all requests
+{{- if .Page }}
+    ErrorDocument 403 /{{ .Page }}
+{{- else }}
+    ErrorDocument 403 "Forbidden: This domain is not configured on this server."
+{{- end }}
+{{- end }}
+</VirtualHost>
+{{ end }}
+
+{{- define "challenges" }}
+{{- if .ChallengeDir }}
+
+    Alias /.well-known/acme-challenge/ {{ .ChallengeDir }}/
+    <Directory {{ .ChallengeDir }}>
+        Require all granted
+    </Directory>
+{{- end }}
+{{- end }}
+
+{{- define "mount" }}
+{{- with .Site.PathPrefix }}
+    Alias {{ . }} {{ $.Path }}
+{{- end }}
+    <Directory {{ .Path }}>
+        Options Indexes SymLinksIfOwnerMatch
+        AllowOverride All
+{{- with .Access }}
+{{- if $.HtpasswdFile }}
+        AuthType Basic
+        AuthName "{{ $.Site.DomainName }}"
+        AuthUserFile {{ $.HtpasswdFile }}
+{{- end }}
+        <RequireAll>
+{{- if or .Allow $.HtpasswdFile }}
+            <RequireAny>
+{{- range .Allow }}
+                Require ip {{ . }}
+{{- end }}
+{{- if $.HtpasswdFile }}
+                Require valid-user
+{{- end }}
+            </RequireAny>
+{{- else }}
+            Require all granted
+{{- end }}
+{{- range .Deny }}
+            Require not ip {{ . }}
+{{- end }}
+        </RequireAll>
+{{- else }}
+        Require all granted
+{{- end }}
+{{- with .FPMSocket }}
+        <FilesMatch "\.php$">
+            SetHandler "proxy:unix:{{ . }}|fcgi://localhost"
+        </FilesMatch>
+{{- end }}
+{{- with .Site.Network }}
+        # Multisite network
+        RewriteEngine On
+        RewriteBase {{ $.Site.PathPrefix }}/
+        RewriteRule ^index\.php$ - [L]
+{{- if eq .Mode "subdomain" }}
+        RewriteRule ^wp-admin$ wp-admin/ [R=301,L]
+{{- else }}
+        RewriteRule ^([_0-9a-zA-Z-]+/)?wp-admin$ $1wp-admin/ [R=301,L]
+{{- end }}
+        RewriteCond %{REQUEST_FILENAME} -f [OR]
+        RewriteCond %{REQUEST_FILENAME} -d
+        RewriteRule ^ - [L]
+{{- if eq .Mode "subdomain" }}
+        RewriteRule ^(wp-(content|admin|includes).*) $1 [L]
+        RewriteRule ^(.*\.php)$ $1 [L]
+{{- else }}
+        RewriteRule ^([_0-9a-zA-Z-]+/)?(wp-(content|admin|includes).*) $2 [L]
+        RewriteRule ^([_0-9a-zA-Z-]+/)?(.*\.php)$ $2 [L]
+{{- end }}
+        RewriteRule . index.php [L]
+{{- end }}
+{{- with .PHPSettings }}
+        <IfModule php_module>
+{{- range . }}
+            php_admin_value {{ .Key }} {{ .Value }}
+{{- end }}
+        </IfModule>
+{{- end }}
+    </Directory>
+{{- with .Access }}
+{{- range .ExemptPaths }}
+
+    <Location "{{ $.Site.PathPrefix }}{{ . }}">
+        Require all granted
+    </Location>
+{{- end }}
+{{- end }}
+{{- end }}
+
+{{- define "body" }}
+    DocumentRoot {{ .DocumentRoot }}
+{{- with .Logs.Rewrite }}
+
+    # Access log fields
+{{- range . }}
+    {{ . }}
+{{- end }}
+{{- end }}
+{{- if not .HasRoot }}
+
+    <Directory {{ .DocumentRoot }}>
+        Require all denied
+    </Directory>
+{{- end }}
+{{- range .Mounts }}
+{{ template "mount" . }}
+{{- end }}
+
+{{- if .MaintenancePage }}
+
+    # Maintenance mode
+    Alias {{ .MaintenanceURI }} {{ .MaintenancePage }}
+    <Directory {{ .MaintenanceDir }}>
+        Require all granted
+    </Directory>
+    ErrorDocument 503 {{ .MaintenanceURI }}
+    Header always set Retry-After "{{ .RetryAfter }}" "expr=%{REQUEST_STATUS} == 503"
+    RewriteEngine On
+    RewriteCond %{REQUEST_URI} !={{ .MaintenanceURI }}
+{{- if .ChallengeDir }}
+    RewriteCond %{REQUEST_URI} !^/\.well-known/acme-challenge/
+{{- end }}
+{{- range .AllowIPs }}
+    RewriteCond expr "! -R '{{ . }}'"
+{{- end }}
+    RewriteRule ^ - [R=503,L]
+{{- end }}
+{{- with .Redirects }}
+
+    # Redirects
+    RewriteEngine On
+{{- range . }}
+    RewriteRule {{ .Pattern }} {{ .Substitution }} [{{ .Flags }}]
+{{- end }}
+{{- end }}
+
+{{- with .Headers }}
+
+    # Security headers
+{{- range . }}
+    Header always set {{ .Name }} {{ .Quoted }}
+{{- end }}
+{{- end }}
+{{- if .Hardening }}
+
+    # Hardening
+    <Files "xmlrpc.php">
+        Require all denied
+    </Files>
+    <FilesMatch "^(wp-config\.php|readme\.html|\.ht.*)$">
+        Require all denied
+    </FilesMatch>
+{{- range .Mounts }}
+    <Directory {{ .Path }}/wp-content/uploads>
+        <FilesMatch "\.(php[0-9]?|phtml|phar)$">
+            Require all denied
+        </FilesMatch>
+    </Directory>
+{{- end }}
+{{- end }}
+{{- with .Cache }}
+
+    # Page cache
+    CacheQuickHandler off
+    CacheRoot {{ .Root }}
+    CacheEnable disk /
+{{- range .BypassPaths }}
+    CacheDisable {{ . }}
+{{- end }}
+    CacheDefaultExpire {{ .TTL }}
+    CacheMaxExpire {{ .TTL }}
+    CacheIgnoreNoLastMod On
+    CacheIgnoreHeaders Set-Cookie
+    CacheHeader on
+    SetEnvIf Cookie "{{ .CookiePattern }}" no-cache
+    RequestHeader set Cache-Control no-cache env=no-cache
+{{- end }}
+{{ with .Logs.LogFormat }}
+    LogFormat {{ . }}
+{{- end }}
+    ErrorLog {{ .Logs.ErrorLog }}
+    CustomLog {{ .Logs.CustomLog }}
+{{- end }}
+{{- if .TLS }}
+<VirtualHost *>
+{{- template "names" . }}
+{{- template "challenges" . }}
+
+    RewriteEngine On
+{{- if .ChallengeDir }}
+    RewriteCond %{REQUEST_URI} !^/\.well-known/acme-challenge/
+{{- end }}
+    RewriteRule ^ https://%{SERVER_NAME}%{REQUEST_URI} [R=301,L]
+</VirtualHost>
+
+<VirtualHost *:{{ .HTTPSPort }}>
+{{- template "names" . }}
+
+    SSLEngine on
+    SSLCertificateFile {{ .CertFile }}
+    SSLCertificateKeyFile {{ .KeyFile }}
+{{ template "body" . }}
+</VirtualHost>
+{{- else }}
+<VirtualHost *>
+{{- template "names" . }}
+{{- template "challenges" . }}
+{{ template "body" . }}
+</VirtualHost>
+{{- end }}
+`))
+
+func renderVHost(d vhostData) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(managedHeader)
+	if err := vhostTemplate.Execute(&buf, d); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
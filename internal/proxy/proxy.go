@@ -4,8 +4,27 @@ import (
 	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
 )
 
+// Mount is a site served under a path prefix of another site's domain,
+// installed at Path.
+type Mount struct {
+	Site cfg.Site
+	Path string
+}
+
 // Manager is an interface for proxy managers.
 type Manager interface {
-	Configure(site cfg.Site, sitePath string) error
+	// Configure renders the site of a domain installed at sitePath, together
+	// with the sites mounted under path prefixes of the same domain.
+	Configure(site cfg.Site, sitePath string, mounts ...Mount) error
 	Enable(site cfg.Site) error
+	// ConfigureDefault renders the catch-all site answering requests for
+	// unknown hosts. serve, servePath and mounts are set in "serve:<domain>"
+	// mode.
+	ConfigureDefault(def cfg.DefaultSite, serve *cfg.Site, servePath string, mounts ...Mount) error
+	// EnableDefault enables the catch-all site ahead of every other site.
+	EnableDefault() error
+	// PurgeCache empties the page cache of a site.
+	PurgeCache(site cfg.Site) error
+	// Prune removes the sites of domains no longer among sites.
+	Prune(sites []cfg.Site) error
 }
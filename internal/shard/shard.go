@@ -0,0 +1,84 @@
+// Package shard selects the domains a controller reconciles when the sites
+// of a configuration are split between several controllers.
+package shard
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	cfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// Selector decides which domains a controller is eligible for. Controllers
+// with the same selector share its domains.
+type Selector struct {
+	spec  string
+	match func(primary cfg.Site) bool
+}
+
+// Parse parses a selector: "all" for every domain, "hash:i/n" for the domains
+// hashing to i modulo n, or "label:key=value" for the domains whose primary
+// site has the label.
+func Parse(spec string) (Selector, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "all":
+		if arg != "" {
+			break
+		}
+		return Selector{spec: spec, match: func(cfg.Site) bool { return true }}, nil
+	case "hash":
+		is, ns, ok := strings.Cut(arg, "/")
+		i, err1 := strconv.ParseUint(is, 10, 32)
+		n, err2 := strconv.ParseUint(ns, 10, 32)
+		if !ok || err1 != nil || err2 != nil || n == 0 || i >= n {
+			return Selector{}, fmt.Errorf("shard %q: want hash:i/n with 0 <= i < n", spec)
+		}
+		return Selector{spec: spec, match: func(site cfg.Site) bool {
+			return hash(site.DomainName)%uint32(n) == uint32(i)
+		}}, nil
+	case "label":
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return Selector{}, fmt.Errorf("shard %q: want label:key=value", spec)
+		}
+		return Selector{spec: spec, match: func(site cfg.Site) bool {
+			v, ok := site.Labels[key]
+			return ok && v == value
+		}}, nil
+	}
+	return Selector{}, fmt.Errorf("shard %q: want all, hash:i/n or label:key=value", spec)
+}
+
+// String returns the selector as parsed.
+func (s Selector) String() string { return s.spec }
+
+// Group names the controllers sharing the selector's domains. It is safe to
+// use in file and object names.
+func (s Selector) Group() string {
+	return fmt.Sprintf("%08x", hash(s.spec))
+}
+
+// Domains returns the domains of c the selector matches, in order. Sites
+// sharing a domain are served by one vhost, so they are selected together
+// through the domain's primary site.
+func (s Selector) Domains(c *cfg.Config) []string {
+	if c == nil {
+		return nil
+	}
+	var domains []string
+	for _, group := range cfg.GroupByDomain(c.Sites) {
+		if s.match(group[0]) {
+			domains = append(domains, group[0].DomainName)
+		}
+	}
+	return domains
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+
+	cfgpkg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// ChangedDomains compares two configurations and returns the domains whose
+// sites were added, removed or changed. all is set instead when settings
+// shared by every site changed, or old is nil.
+func ChangedDomains(old, new *cfgpkg.Config) (domains []string, all bool) {
+	if old == nil || new == nil {
+		return nil, true
+	}
+	if digest(globalsOf(old)) != digest(globalsOf(new)) {
+		return nil, true
+	}
+	before := domainDigests(old)
+	for d, sum := range domainDigests(new) {
+		if before[d] != sum {
+			domains = append(domains, d)
+		}
+		delete(before, d)
+	}
+	// Removed domains are queued too, so the run prunes their vhosts and
+	// pools.
+	for d := range before {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	return domains, false
+}
+
+// globalSettings are the parts of a configuration every site depends on.
+type globalSettings struct {
+	Proxy           cfgpkg.Proxy
+	WordpressGlobal cfgpkg.WordpressGlobal
+	ACME            cfgpkg.ACME
+}
+
+func globalsOf(cfg *cfgpkg.Config) globalSettings {
+	return globalSettings{cfg.Proxy, cfg.WordpressGlobal, cfg.ACME}
+}
+
+// domainDigests returns the digest of the sites of each domain.
+func domainDigests(cfg *cfgpkg.Config) map[string]string {
+	sums := map[string]string{}
+	for _, group := range cfgpkg.GroupByDomain(cfg.Sites) {
+		sums[group[0].DomainName] = digest(group)
+	}
+	return sums
+}
+
+// digest returns a hash of the YAML encoding of v.
+func digest(v any) string {
+	b, _ := yaml.Marshal(v)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
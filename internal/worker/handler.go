@@ -3,6 +3,7 @@ package worker
 import (
 	"archive/zip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,95 +11,381 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/eryalito/multi-wordpress-file-manager/internal/export"
+	"github.com/eryalito/multi-wordpress-file-manager/internal/fpm"
+	"github.com/eryalito/multi-wordpress-file-manager/internal/lock"
 	"github.com/eryalito/multi-wordpress-file-manager/internal/proxy"
 	"github.com/eryalito/multi-wordpress-file-manager/internal/proxy/apache"
 	cfgpkg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
 )
 
-// Handle is the default worker function. Replace its body with real work.
-func Handle(ctx context.Context, cfg *cfgpkg.Config) error {
-	if cfg == nil {
-		log.Printf("worker: no config loaded yet; skipping run")
+// NewProxyManager returns the manager of the proxy type configured in cfg.
+func NewProxyManager(cfg *cfgpkg.Config) (proxy.Manager, error) {
+	switch cfg.Proxy.Type {
+	case cfgpkg.ProxyTypeApache:
+		return &apache.ApacheManager{
+			HTTPSPort:        cfg.Proxy.HTTPSPort,
+			ACMEChallengeDir: acmeIssuer(cfg).ChallengeDir(),
+			SecurityHeaders:  cfg.Proxy.SecurityHeaders,
+			Hardening:        cfg.Proxy.Hardening,
+			Logging:          cfg.Proxy.Logging,
+			FPM:              newFPMManager(cfg),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy type: %s", cfg.Proxy.Type)
+	}
+}
+
+// newFPMManager returns the PHP-FPM pool manager, or nil when PHP-FPM is not
+// enabled.
+func newFPMManager(cfg *cfgpkg.Config) *fpm.Manager {
+	if !cfg.Proxy.FPM.Enabled {
 		return nil
 	}
+	return fpm.New(cfg.Proxy.FPM)
+}
+
+// Handler reconciles configurations. It keeps the retry state of the domains
+// whose reconcile failed between runs: they are retried with exponential
+// backoff, or not at all until their configuration changes if the error is
+// permanent, while the other domains are reconciled on every run.
+type Handler struct {
+	// newProxy returns the proxy manager of a configuration; NewProxyManager
+	// unless replaced in tests.
+	newProxy func(cfg *cfgpkg.Config) (proxy.Manager, error)
+
+	// Retry, when set, is called with a failed domain and the delay after
+	// which it is due for a retry, e.g. Worker.TriggerSiteAfter.
+	Retry   func(domain string, delay time.Duration)
+	retries retries
+}
 
-	log.Println("worker: starting wordpress deployment check")
+// NewHandler returns a Handler without failed domains.
+func NewHandler() *Handler {
+	return &Handler{newProxy: NewProxyManager, retries: retries{}}
+}
 
-	// Path for the downloaded wordpress zip
-	zipPath := "/tmp/wordpress.zip"
+// Handle is the worker function. It reconciles the sites of domains, or every
+// site if domains is nil; the default site, PHP-FPM pools and Traefik
+// configuration are kept up to date on every run. The vhosts and PHP-FPM
+// pools are local to the pod, so every member renders them for every site.
+// The sites' files, wp-config.php, certificates and the Traefik
+// configuration live on shared storage: only the member holding the lock
+// carried by ctx writes them, after checking its fencing token, and under
+// site locks only for the domains whose lock it holds.
+func (h *Handler) Handle(ctx context.Context, cfg *cfgpkg.Config, domains []string) error {
+	if cfg == nil {
+		log.Printf("worker: no config loaded yet; skipping run")
+		return nil
+	}
 
-	// Check if wordpress zip is already downloaded
-	if _, err := os.Stat(zipPath); os.IsNotExist(err) {
-		log.Printf("worker: wordpress not found at %s, downloading from %s", zipPath, cfg.WordpressGlobal.ZipURL)
-		if err := downloadFile(zipPath, cfg.WordpressGlobal.ZipURL); err != nil {
-			return fmt.Errorf("worker: failed to download wordpress: %w", err)
+	var wanted map[string]bool
+	if domains != nil {
+		log.Printf("worker: starting wordpress deployment check of %s", strings.Join(domains, ", "))
+		wanted = map[string]bool{}
+		for _, d := range domains {
+			wanted[d] = true
 		}
-		log.Printf("worker: wordpress downloaded successfully to %s", zipPath)
 	} else {
-		log.Printf("worker: found existing wordpress zip at %s", zipPath)
+		log.Println("worker: starting wordpress deployment check")
 	}
 
+	// The wordpress zip is downloaded when a site is first installed
+	wp := archive{path: "/tmp/wordpress.zip", url: cfg.WordpressGlobal.ZipURL}
+
 	// Ensure the BasePath directory exists
 	if err := os.MkdirAll(cfg.WordpressGlobal.BasePath, os.ModePerm); err != nil {
 		return fmt.Errorf("worker: failed to create base path directory %s: %w", cfg.WordpressGlobal.BasePath, err)
 	}
-
-	var proxyManager proxy.Manager
-	switch cfg.Proxy.Type {
-	case cfgpkg.ProxyTypeApache:
-		proxyManager = &apache.ApacheManager{}
-	default:
-		return fmt.Errorf("unsupported proxy type: %s", cfg.Proxy.Type)
+	if domains == nil {
+		// Installs cut off by a crash, or of sites removed since, left
+		// these behind.
+		sweepLeftovers(ctx, cfg)
 	}
 
-	for _, site := range cfg.Sites {
-		sitePath := filepath.Join(cfg.WordpressGlobal.BasePath, site.DomainName)
-		log.Printf("worker: processing site %s at path %s", site.DomainName, sitePath)
-
-		wpSettingsPath := filepath.Join(sitePath, "wp-settings.php")
-		if _, err := os.Stat(wpSettingsPath); os.IsNotExist(err) {
-			log.Printf("worker: wordpress not installed for site %s, installing now", site.DomainName)
+	fpmManager := newFPMManager(cfg)
+	proxyManager, err := h.newProxy(cfg)
+	if err != nil {
+		return err
+	}
 
-			// Create site directory if it doesn't exist
-			if err := os.MkdirAll(sitePath, os.ModePerm); err != nil {
-				return fmt.Errorf("worker: failed to create site directory %s: %w", sitePath, err)
-			}
+	if def := cfg.Proxy.DefaultSite; def != nil {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("worker: run aborted: %w", err)
+		}
+		if err := configureDefaultSite(cfg, *def, proxyManager); err != nil {
+			return fmt.Errorf("worker: failed to configure default site: %w", err)
+		}
+	}
 
-			// Unzip wordpress
-			if err := unzip(zipPath, sitePath); err != nil {
-				return fmt.Errorf("worker: failed to unzip wordpress for site %s: %w", site.DomainName, err)
+	failed := 0
+	handled := map[string]bool{}
+	for _, group := range cfgpkg.GroupByDomain(cfg.Sites) {
+		domain := group[0].DomainName
+		handled[domain] = true
+		if wanted != nil && !wanted[domain] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("worker: run aborted: %w", err)
+		}
+		shared := lock.Holds(ctx, domain)
+		fp := fingerprint(cfg, group)
+		if f := h.retries.pending(domain, fp, time.Now()); f != nil {
+			if f.permanent {
+				log.Printf("worker: skipping site %s until its configuration changes: %v", domain, f.err)
+			} else {
+				log.Printf("worker: skipping site %s until %s after %d failed attempt(s): %v", domain, f.next.Format(time.RFC3339), f.attempts, f.err)
 			}
-			log.Printf("worker: successfully unzipped wordpress for site %s", site.DomainName)
+			failed++
+			continue
 		}
 
-		// Ensure wp-config.php is present and correct
-		if err := ensureWPConfig(sitePath, site); err != nil {
-			return fmt.Errorf("worker: failed to ensure wp-config.php for site %s: %w", site.DomainName, err)
+		err := reconcileDomain(lock.ForSite(ctx, domain), cfg, group, wp, shared, fpmManager, proxyManager)
+		if err == nil {
+			delete(h.retries, domain)
+			continue
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if errors.Is(err, lock.ErrStaleFence) {
+			// Another member took the domain over; carry on with the others.
+			log.Printf("%v; leaving site %s to the member holding its lock", err, domain)
+			continue
+		}
+		failed++
+		f := h.retries.fail(domain, fp, err, time.Now())
+		if f.permanent {
+			log.Printf("%v; not retrying until the configuration of site %s changes", err, domain)
+			continue
+		}
+		delay := time.Until(f.next)
+		log.Printf("%v; retrying in %s (attempt %d)", err, delay.Round(time.Second), f.attempts)
+		if h.Retry != nil {
+			h.Retry(domain, delay)
 		}
+	}
+	// Forget the retry state of domains no longer configured.
+	h.retries.prune(handled)
 
-		// Configure and enable proxy
-		if err := proxyManager.Configure(site, sitePath); err != nil {
-			return fmt.Errorf("worker: failed to configure proxy for site %s: %w", site.DomainName, err)
+	// PHP-FPM, Apache and Traefik reload on every file written; once ctx is
+	// done nothing more is written, so the shutdown grace period bounds them.
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("worker: run aborted: %w", err)
+	}
+	if fpmManager != nil {
+		if err := fpmManager.Prune(cfg.Sites); err != nil {
+			return fmt.Errorf("worker: failed to prune php-fpm pools: %w", err)
 		}
-		if err := proxyManager.Enable(site); err != nil {
-			return fmt.Errorf("worker: failed to enable proxy for site %s: %w", site.DomainName, err)
+	}
+	if err := proxyManager.Prune(cfg.Sites); err != nil {
+		return fmt.Errorf("worker: failed to prune proxy sites: %w", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("worker: run aborted: %w", err)
+	}
+	if t := cfg.Proxy.Traefik; t != nil && lock.CheckFence(ctx) == nil {
+		if err := export.WriteTraefik(cfg, *t); err != nil {
+			return fmt.Errorf("worker: failed to write traefik config: %w", err)
 		}
-		log.Printf("worker: successfully configured and enabled proxy for site %s", site.DomainName)
 	}
 
+	if failed > 0 {
+		return fmt.Errorf("worker: %d site(s) not reconciled", failed)
+	}
 	log.Println("worker: finished wordpress deployment check")
 	return nil
 }
 
-func ensureWPConfig(sitePath string, site cfgpkg.Site) error {
+// reconcileDomain reconciles the sites of a domain. With shared, the member
+// holds the domain's lock and writes to shared storage: it installs the
+// sites, keeps their wp-config.php up to date and issues the certificates
+// the controller manages. Their PHP-FPM pools and the vhost serving them,
+// local to the pod, are configured in any case, even when an install fails,
+// with the certificates issued so far; a site whose install failed or whose
+// certificate is not issued yet is served anyway and retried. Sites mounted under a path prefix share the vhost of
+// their domain's primary site, which comes first in group.
+func reconcileDomain(ctx context.Context, cfg *cfgpkg.Config, group []cfgpkg.Site, wp archive, shared bool, fpmManager *fpm.Manager, proxyManager proxy.Manager) error {
+	site := group[0]
+	mounts := make([]proxy.Mount, len(group))
+	for i, s := range group {
+		mounts[i] = proxy.Mount{Site: s, Path: filepath.Join(cfg.WordpressGlobal.BasePath, s.ID())}
+	}
+	// Install failures, such as a network waiting to be created, are
+	// reported once the site is served, so the run is retried.
+	var installErr error
+	if shared {
+		for _, m := range mounts {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			err := installSite(ctx, wp, m.Site, m.Path, installedMarker(cfg, m.Site), siteURL(site, m.Site))
+			if errors.Is(err, lock.ErrStaleFence) {
+				log.Printf("%v; only configuring the proxy of site %s", err, site.DomainName)
+				shared = false
+				break
+			}
+			if errors.Is(err, errNetworkPending) {
+				installErr = errors.Join(installErr, err)
+				continue
+			}
+			if err != nil {
+				log.Printf("%v; configuring the proxy of site %s anyway", err, site.DomainName)
+				installErr = errors.Join(installErr, err)
+			}
+		}
+	}
+
+	// Configure the sites' PHP-FPM pools before the proxy points at them
+	if fpmManager != nil {
+		for _, m := range mounts {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fpmManager.Configure(m.Site, m.Path); err != nil {
+				return fmt.Errorf("worker: failed to configure php-fpm pool for site %s: %w", m.Site.ID(), err)
+			}
+		}
+	}
+
+	// Issue certificates managed by the controller
+	tls, pending, err := ensureCertificates(ctx, cfg, site, shared)
+	if err != nil {
+		return fmt.Errorf("worker: failed to ensure certificate for site %s: %w", site.DomainName, err)
+	}
+	site.TLS = tls
+	sitePath := mounts[0].Path
+	mounts = mounts[1:]
+
+	// Configure and enable proxy
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := proxyManager.Configure(site, sitePath, mounts...); err != nil {
+		return fmt.Errorf("worker: failed to configure proxy for site %s: %w", site.DomainName, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := proxyManager.Enable(site); err != nil {
+		return fmt.Errorf("worker: failed to enable proxy for site %s: %w", site.DomainName, err)
+	}
+	log.Printf("worker: successfully configured and enabled proxy for site %s", site.DomainName)
+	if pending {
+		return errors.Join(installErr, fmt.Errorf("worker: certificate for site %s not issued yet by the member holding its lock", site.DomainName))
+	}
+
+	// ACME certificates are ordered once the site is served, so the CA
+	// can fetch the challenge responses; the vhost is then reconfigured.
+	if !shared || !needsACMECertificate(cfg, site) {
+		return installErr
+	}
+	log.Printf("worker: ordering ACME certificate for site %s", site.DomainName)
+	if err := lock.CheckFence(ctx); err != nil {
+		return fmt.Errorf("worker: failed to obtain ACME certificate for site %s: %w", site.DomainName, err)
+	}
+	tls, err = obtainACMECertificate(ctx, cfg, site)
+	if err != nil && site.TLS.CertFile != "" {
+		// The current certificate is still valid; retry the renewal later.
+		log.Printf("worker: failed to renew ACME certificate for site %s: %v", site.DomainName, err)
+		return installErr
+	}
+	if err != nil {
+		return fmt.Errorf("worker: failed to obtain ACME certificate for site %s: %w", site.DomainName, err)
+	}
+	site.TLS = tls
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := proxyManager.Configure(site, sitePath, mounts...); err != nil {
+		return fmt.Errorf("worker: failed to configure proxy for site %s: %w", site.DomainName, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := proxyManager.Enable(site); err != nil {
+		return fmt.Errorf("worker: failed to enable proxy for site %s: %w", site.DomainName, err)
+	}
+	log.Printf("worker: ACME certificate installed for site %s", site.DomainName)
+	return installErr
+}
+
+// installSite installs WordPress for a site at sitePath if needed and keeps
+// its wp-config.php up to date. marker is the site's completion marker and
+// home the address WordPress is pinned to, if any.
+func installSite(ctx context.Context, wp archive, site cfgpkg.Site, sitePath, marker, home string) error {
+	log.Printf("worker: processing site %s at path %s", site.ID(), sitePath)
+
+	if err := ensureInstalled(ctx, wp, site, sitePath, marker); err != nil {
+		return fmt.Errorf("worker: failed to install wordpress for site %s: %w", site.ID(), err)
+	}
+
+	// Ensure wp-config.php is present and correct
+	if err := ensureWPConfig(ctx, sitePath, site, home); errors.Is(err, errNetworkPending) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("worker: failed to ensure wp-config.php for site %s: %w", site.ID(), err)
+	}
+	return nil
+}
+
+// siteURL returns the address of a site served under a path prefix, which
+// WordPress is pinned to through WP_HOME and WP_SITEURL so the links it
+// generates include the prefix. It is empty for sites at the root of their
+// domain.
+func siteURL(primary, site cfgpkg.Site) string {
+	if site.PathPrefix == "" {
+		return ""
+	}
+	scheme := "http"
+	if primary.TLS != nil || (site.Wordpress.ForceHTTPS != nil && *site.Wordpress.ForceHTTPS) {
+		scheme = "https"
+	}
+	return scheme + "://" + site.DomainName + site.PathPrefix
+}
+
+// configureDefaultSite renders and enables the catch-all site. In serve mode
+// it is backed by the configured sites of the domain it names.
+func configureDefaultSite(cfg *cfgpkg.Config, def cfgpkg.DefaultSite, proxyManager proxy.Manager) error {
+	var serve *cfgpkg.Site
+	var servePath string
+	var mounts []proxy.Mount
+	if action, domain := def.Action(); action == cfgpkg.DefaultSiteServe {
+		for _, group := range cfgpkg.GroupByDomain(cfg.Sites) {
+			if group[0].DomainName != domain {
+				continue
+			}
+			serve = &group[0]
+			servePath = filepath.Join(cfg.WordpressGlobal.BasePath, serve.ID())
+			for _, s := range group[1:] {
+				mounts = append(mounts, proxy.Mount{Site: s, Path: filepath.Join(cfg.WordpressGlobal.BasePath, s.ID())})
+			}
+			break
+		}
+	}
+	if err := proxyManager.ConfigureDefault(def, serve, servePath, mounts...); err != nil {
+		return err
+	}
+	return proxyManager.EnableDefault()
+}
+
+func ensureWPConfig(ctx context.Context, sitePath string, site cfgpkg.Site, home string) error {
 	wpConfigPath := filepath.Join(sitePath, "wp-config.php")
 	wpConfig := site.Wordpress
 
 	if _, err := os.Stat(wpConfigPath); os.IsNotExist(err) {
-		log.Printf("worker: wp-config.php not found for site %s, creating it", site.DomainName)
-		return createWPConfig(sitePath, wpConfig)
+		log.Printf("worker: wp-config.php not found for site %s, creating it", site.ID())
+		created := networkReady(ctx, site, nil)
+		if err := createWPConfig(ctx, sitePath, site, home, created); err != nil {
+			return err
+		}
+		return networkPending(site, created)
 	}
 
 	// File exists, check if an update is needed.
@@ -109,73 +396,125 @@ func ensureWPConfig(sitePath string, site cfgpkg.Site) error {
 
 	// Extract current config from file content
 	currentConfig := parseWPConfig(content)
+	if site.Network == nil && currentConfig["MULTISITE"] == "true" {
+		return permanent(fmt.Errorf("wp-config.php defines a multisite network, which WordPress cannot convert back to a single site; set network in the configuration of site %s", site.ID()))
+	}
+
+	created := networkReady(ctx, site, currentConfig)
 
 	// Compare with new config from yaml
 	newDBHost := fmt.Sprintf("%s:%d", wpConfig.Database.Host, wpConfig.Database.Port)
 	if currentConfig["DB_NAME"] == wpConfig.Database.Name &&
 		currentConfig["DB_USER"] == wpConfig.Database.User &&
 		currentConfig["DB_PASSWORD"] == wpConfig.Database.Password &&
-		currentConfig["DB_HOST"] == newDBHost {
-		log.Printf("worker: wp-config.php for site %s is up to date", site.DomainName)
-		return nil
+		currentConfig["DB_HOST"] == newDBHost &&
+		currentConfig["WP_HOME"] == home &&
+		currentConfig["WP_SITEURL"] == home &&
+		networkUpToDate(currentConfig, site, created) {
+		log.Printf("worker: wp-config.php for site %s is up to date", site.ID())
+		return networkPending(site, created)
 	}
 
-	log.Printf("worker: database configuration for site %s has changed, updating wp-config.php", site.DomainName)
+	log.Printf("worker: configuration for site %s has changed, updating wp-config.php", site.ID())
 
 	// Config has changed, regenerate the file preserving salts.
 	salts := extractSalts(content)
 	if salts == "" {
-		log.Printf("worker: could not find salts in existing wp-config.php for site %s, fetching new ones.", site.DomainName)
+		log.Printf("worker: could not find salts in existing wp-config.php for site %s, fetching new ones.", site.ID())
 		salts, err = getSalts()
 		if err != nil {
 			return fmt.Errorf("failed to get new salts: %w", err)
 		}
 	}
 
-	return writeWPConfig(sitePath, wpConfig, salts)
+	if err := writeWPConfig(ctx, sitePath, site, home, salts, created); err != nil {
+		return err
+	}
+	return networkPending(site, created)
 }
 
-// parseWPConfig extracts database credentials from wp-config.php content.
+// parseWPConfig extracts the constants defined in wp-config.php content, such
+// as the database credentials.
 func parseWPConfig(content []byte) map[string]string {
 	config := make(map[string]string)
-	// Regex to find define('KEY', 'VALUE');
-	re := regexp.MustCompile(`define\(\s*'([^']*)'\s*,\s*'([^']*)'\s*\);`)
+	// Regex to find define('KEY', 'VALUE'); or define('KEY', true);
+	re := regexp.MustCompile(`define\(\s*'([^']*)'\s*,\s*(?:'([^']*)'|(true|false|[0-9]+))\s*\);`)
 	matches := re.FindAllStringSubmatch(string(content), -1)
 	for _, match := range matches {
-		if len(match) == 3 {
-			config[match[1]] = match[2]
+		if len(match) == 4 {
+			config[match[1]] = match[2] + match[3]
 		}
 	}
 	return config
 }
 
-// extractSalts pulls the block of salt definitions from wp-config.php content.
-func extractSalts(content []byte) string {
-	re := regexp.MustCompile(`(?s)define\(\s*'AUTH_KEY'.*require_once`)
-	match := re.Find(content)
-	if match != nil {
-		// Trim the require_once from the end
-		matchStr := string(match)
-		lastIndex := strings.LastIndex(matchStr, "require_once")
-		if lastIndex != -1 {
-			return strings.TrimSpace(matchStr[:lastIndex])
+// networkConstants returns the wp-config.php constants of a site's multisite
+// network as name and PHP literal pairs, in the order they are written. Until
+// created, the network is only allowed.
+func networkConstants(site cfgpkg.Site, created bool) [][2]string {
+	n := site.Network
+	if n == nil {
+		return nil
+	}
+	if !created {
+		// WordPress fails to load with MULTISITE set before the network
+		// tables exist; until then it only offers to create the network.
+		return [][2]string{{"WP_ALLOW_MULTISITE", "true"}}
+	}
+	return [][2]string{
+		{"WP_ALLOW_MULTISITE", "true"},
+		{"MULTISITE", "true"},
+		{"SUBDOMAIN_INSTALL", strconv.FormatBool(n.Mode == cfgpkg.NetworkModeSubdomain)},
+		{"DOMAIN_CURRENT_SITE", "'" + site.DomainName + "'"},
+		{"PATH_CURRENT_SITE", "'" + site.PathPrefix + "/'"},
+		{"SITE_ID_CURRENT_SITE", "1"},
+		{"BLOG_ID_CURRENT_SITE", "1"},
+	}
+}
+
+// networkUpToDate reports whether the constants parsed from wp-config.php
+// match the site's multisite network, created or not. A standalone site must
+// not allow a network either, so removing network before the network was
+// created takes effect right away.
+func networkUpToDate(current map[string]string, site cfgpkg.Site, created bool) bool {
+	if site.Network == nil {
+		_, allowed := current["WP_ALLOW_MULTISITE"]
+		return !allowed
+	}
+	for _, c := range networkConstants(site, created) {
+		if current[c[0]] != strings.Trim(c[1], "'") {
+			return false
 		}
 	}
-	return ""
+	return true
+}
+
+// saltPattern matches the lines defining the authentication keys and salts.
+var saltPattern = regexp.MustCompile(`(?m)^define\(\s*'(AUTH|SECURE_AUTH|LOGGED_IN|NONCE)_(KEY|SALT)'.*$`)
+
+// extractSalts pulls the salt definitions from wp-config.php content. Only
+// the define lines are kept, so the rest of the file is not carried over into
+// the regenerated one.
+func extractSalts(content []byte) string {
+	return strings.Join(saltPattern.FindAllString(string(content), -1), "\n")
 }
 
 // createWPConfig creates a new wp-config.php file, fetching new salts.
-func createWPConfig(dest string, wpConfig cfgpkg.Wordpress) error {
+func createWPConfig(ctx context.Context, dest string, site cfgpkg.Site, home string, created bool) error {
 	salts, err := getSalts()
 	if err != nil {
 		return fmt.Errorf("failed to get salts: %w", err)
 	}
-	return writeWPConfig(dest, wpConfig, salts)
+	return writeWPConfig(ctx, dest, site, home, salts, created)
 }
 
-// writeWPConfig writes the wp-config.php file with the given credentials and salts.
-func writeWPConfig(dest string, wpConfig cfgpkg.Wordpress, salts string) error {
+// writeWPConfig writes the wp-config.php file of a site with its credentials,
+// address, multisite network and the given salts, unless the fencing token
+// in ctx is stale. created tells whether the network tables exist. The file
+// is replaced atomically, so it is never left half written.
+func writeWPConfig(ctx context.Context, dest string, site cfgpkg.Site, home, salts string, created bool) error {
 	wpConfigPath := filepath.Join(dest, "wp-config.php")
+	wpConfig := site.Wordpress
 	configContent := fmt.Sprintf(`<?php
 %s
 
@@ -185,21 +524,31 @@ define( 'DB_PASSWORD', '%s' );
 define( 'DB_HOST', '%s' );
 define( 'DB_CHARSET', 'utf8' );
 define( 'DB_COLLATE', '' );
-
+%s
 %s
 
 $table_prefix = 'wp_';
 
 define( 'WP_DEBUG', false );
-
+%s
 if ( ! defined( 'ABSPATH' ) ) {
 	define( 'ABSPATH', __DIR__ . '/' );
 }
 
 require_once ABSPATH . 'wp-settings.php';
-`, getForceHTTPSSetting(wpConfig.ForceHTTPS), wpConfig.Database.Name, wpConfig.Database.User, wpConfig.Database.Password, fmt.Sprintf("%s:%d", wpConfig.Database.Host, wpConfig.Database.Port), salts)
+`, getForceHTTPSSetting(wpConfig.ForceHTTPS), wpConfig.Database.Name, wpConfig.Database.User, wpConfig.Database.Password, fmt.Sprintf("%s:%d", wpConfig.Database.Host, wpConfig.Database.Port), getURLSettings(home), salts, getNetworkSettings(site, created))
 
-	return os.WriteFile(wpConfigPath, []byte(configContent), 0644)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := lock.CheckFence(ctx); err != nil {
+		return err
+	}
+	tmp := wpConfigPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(configContent), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, wpConfigPath)
 }
 
 func getForceHTTPSSetting(forceHTTPS *bool) string {
@@ -212,9 +561,36 @@ $_SERVER['SERVER_PORT'] = 443;
 	return ""
 }
 
+func getURLSettings(home string) string {
+	if home != "" {
+		return fmt.Sprintf(`
+define( 'WP_HOME', '%s' );
+define( 'WP_SITEURL', '%s' );
+`, home, home)
+	}
+	return ""
+}
+
+func getNetworkSettings(site cfgpkg.Site, created bool) string {
+	constants := networkConstants(site, created)
+	if len(constants) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n")
+	for _, c := range constants {
+		fmt.Fprintf(&b, "define( '%s', %s );\n", c[0], c[1])
+	}
+	return b.String()
+}
+
+// saltsURL is the WordPress.org API generating keys and salts; replaced in
+// tests.
+var saltsURL = "https://api.wordpress.org/secret-key/1.1/salt/"
+
 // getSalts fetches unique keys and salts from the WordPress.org API.
 func getSalts() (string, error) {
-	resp, err := http.Get("https://api.wordpress.org/secret-key/1.1/salt/")
+	resp, err := http.Get(saltsURL)
 	if err != nil {
 		return "", err
 	}
@@ -228,30 +604,46 @@ func getSalts() (string, error) {
 	return string(body), nil
 }
 
-// downloadFile will download a url to a file. It's not efficient for large files.
-func downloadFile(filepath string, url string) error {
+// downloadFile downloads url to path. The file only appears at path once
+// complete, so an interrupted download is not mistaken for the archive.
+func downloadFile(ctx context.Context, path string, url string) error {
 	// Get the data
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: %s", url, resp.Status)
+	}
 
 	// Create the file
-	out, err := os.Create(filepath)
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
 
 	// Write the body to file
 	_, err = io.Copy(out, resp.Body)
-	return err
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
 }
 
 // unzip will decompress a zip archive, moving all files and folders
 // within the zip file (parameter 1) to an output directory (parameter 2).
-func unzip(src, dest string) error {
+// It stops between files once ctx is canceled.
+func unzip(ctx context.Context, src, dest string) error {
 	r, err := zip.OpenReader(src)
 	if err != nil {
 		return err
@@ -269,13 +661,17 @@ func unzip(src, dest string) error {
 	}
 
 	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Store filename/path for returning and using later on
 		fpath := filepath.Join(dest, strings.TrimPrefix(f.Name, basePath))
 
 		// Check for ZipSlip. More Info: http://bit.ly/2MsjAWE
 		cleanDest := filepath.Clean(dest)
 		if fpath != cleanDest && !strings.HasPrefix(fpath, cleanDest+string(os.PathSeparator)) {
-			return fmt.Errorf("%s: illegal file path", fpath)
+			return permanent(fmt.Errorf("%s: illegal file path", fpath))
 		}
 
 		if f.FileInfo().IsDir() {
@@ -0,0 +1,95 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/eryalito/multi-wordpress-file-manager/internal/lock"
+	"github.com/eryalito/multi-wordpress-file-manager/internal/proxy"
+	cfgpkg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// fakeProxy records the sites configured and enabled.
+type fakeProxy struct {
+	configured map[string]string
+	enabled    map[string]bool
+}
+
+func newFakeProxy() *fakeProxy {
+	return &fakeProxy{configured: map[string]string{}, enabled: map[string]bool{}}
+}
+
+func (p *fakeProxy) Configure(site cfgpkg.Site, sitePath string, mounts ...proxy.Mount) error {
+	p.configured[site.DomainName] = sitePath
+	return nil
+}
+
+func (p *fakeProxy) Enable(site cfgpkg.Site) error {
+	p.enabled[site.DomainName] = true
+	return nil
+}
+
+func (p *fakeProxy) ConfigureDefault(cfgpkg.DefaultSite, *cfgpkg.Site, string, ...proxy.Mount) error {
+	return nil
+}
+
+func (p *fakeProxy) EnableDefault() error { return nil }
+
+func (p *fakeProxy) PurgeCache(cfgpkg.Site) error { return nil }
+
+func (p *fakeProxy) Prune([]cfgpkg.Site) error { return nil }
+
+func TestHandleWithoutLockRendersVHosts(t *testing.T) {
+	base := t.TempDir()
+	cfg := &cfgpkg.Config{
+		WordpressGlobal: cfgpkg.WordpressGlobal{BasePath: base, ZipURL: "http://127.0.0.1:0/wordpress.zip"},
+		Sites: []cfgpkg.Site{
+			{DomainName: "site1.example.com"},
+			{DomainName: "site2.example.com"},
+		},
+	}
+	p := newFakeProxy()
+	h := NewHandler()
+	h.newProxy = func(*cfgpkg.Config) (proxy.Manager, error) { return p, nil }
+
+	// A replica waiting for the lock.
+	ctx := lock.WithLeader(context.Background(), &lock.Leader{})
+	if err := h.Handle(ctx, cfg, nil); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+
+	for _, site := range cfg.Sites {
+		want := filepath.Join(base, site.ID())
+		if got := p.configured[site.DomainName]; got != want {
+			t.Errorf("vhost of %s: configured with %q, want %q", site.DomainName, got, want)
+		}
+		if !p.enabled[site.DomainName] {
+			t.Errorf("vhost of %s not enabled", site.DomainName)
+		}
+		if _, err := os.Stat(want); !os.IsNotExist(err) {
+			t.Errorf("site %s installed without the lock: %v", site.DomainName, err)
+		}
+	}
+}
+
+func TestFailedInstallStillRendersVHost(t *testing.T) {
+	base := t.TempDir()
+	cfg := &cfgpkg.Config{WordpressGlobal: cfgpkg.WordpressGlobal{BasePath: base}}
+	site := cfgpkg.Site{DomainName: "site1.example.com"}
+	// The archive cannot be downloaded.
+	wp := archive{path: filepath.Join(base, "wordpress.zip"), url: "http://127.0.0.1:0/wordpress.zip"}
+	p := newFakeProxy()
+
+	err := reconcileDomain(context.Background(), cfg, []cfgpkg.Site{site}, wp, true, nil, p)
+	if err == nil {
+		t.Fatal("reconcileDomain succeeded without WordPress")
+	}
+	if got, want := p.configured[site.DomainName], filepath.Join(base, site.ID()); got != want {
+		t.Errorf("vhost configured with %q, want %q", got, want)
+	}
+	if !p.enabled[site.DomainName] {
+		t.Error("vhost not enabled")
+	}
+}
@@ -0,0 +1,219 @@
+package worker
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/eryalito/multi-wordpress-file-manager/internal/lock"
+	cfgpkg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// installedMarker returns the completion marker of site, written once
+// WordPress is fully in place. It is kept in the state directory rather than
+// the site's public document root; a site without it is not considered
+// installed.
+func installedMarker(cfg *cfgpkg.Config, site cfgpkg.Site) string {
+	return filepath.Join(stateDir(cfg), "installed", site.ID())
+}
+
+// archive is the WordPress zip sites are installed from. It is downloaded on
+// first use, so members that install nothing never fetch it.
+type archive struct {
+	path string
+	url  string
+}
+
+// fetch returns the path of the archive, downloading it if missing.
+func (a archive) fetch(ctx context.Context) (string, error) {
+	if _, err := os.Stat(a.path); err == nil {
+		return a.path, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	log.Printf("worker: wordpress not found at %s, downloading from %s", a.path, a.url)
+	if err := downloadFile(ctx, a.path, a.url); err != nil {
+		return "", fmt.Errorf("failed to download wordpress: %w", err)
+	}
+	log.Printf("worker: wordpress downloaded successfully to %s", a.path)
+	return a.path, nil
+}
+
+// check removes the archive if err shows it is corrupt, e.g. after a
+// truncated download, so the next attempt downloads it again. It returns err.
+func (a archive) check(err error) error {
+	if errors.Is(err, zip.ErrFormat) || errors.Is(err, zip.ErrChecksum) {
+		log.Printf("worker: wordpress archive %s is corrupt, removing it: %v", a.path, err)
+		if rerr := os.Remove(a.path); rerr != nil && !errors.Is(rerr, fs.ErrNotExist) {
+			log.Printf("worker: failed to remove corrupt archive %s: %v", a.path, rerr)
+		}
+	}
+	return err
+}
+
+// ensureInstalled installs WordPress at sitePath unless the site directory
+// and its completion marker, at marker, are both there. Sites installed
+// before the marker existed, recognizable by their wp-settings.php, are only
+// marked installed: their files are the site's own, as edited or updated
+// since, and are left alone.
+func ensureInstalled(ctx context.Context, wp archive, site cfgpkg.Site, sitePath, marker string) error {
+	if _, err := os.Stat(sitePath); err == nil {
+		_, err := os.Stat(marker)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(sitePath, "wp-settings.php")); err == nil {
+			log.Printf("worker: marking existing wordpress install of site %s as complete", site.ID())
+			if err := lock.CheckFence(ctx); err != nil {
+				return err
+			}
+			return writeInstalledMarker(marker)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	log.Printf("worker: wordpress not installed for site %s, installing now", site.ID())
+	zipPath, err := wp.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if err := installWordPress(ctx, zipPath, site, sitePath, marker); err != nil {
+		return wp.check(err)
+	}
+	log.Printf("worker: successfully installed wordpress for site %s", site.ID())
+	return nil
+}
+
+// installWordPress extracts WordPress into a staging directory next to
+// sitePath, named .staging-<site>-<random>, renames it into place and writes
+// the completion marker, so an interrupted install never leaves a partial
+// site behind. A directory already at sitePath, such as one left by an
+// install interrupted before staging was used, is moved aside to
+// .incomplete-<site>-<time> rather than merged. It may hold files someone
+// added by hand, so it is kept for an operator to inspect and remove.
+func installWordPress(ctx context.Context, zipPath string, site cfgpkg.Site, sitePath, marker string) error {
+	parent := filepath.Dir(sitePath)
+	if err := os.MkdirAll(parent, os.ModePerm); err != nil {
+		return fmt.Errorf("create base path directory: %w", err)
+	}
+	staging, err := os.MkdirTemp(parent, stagingPrefix+filepath.Base(sitePath)+"-")
+	if err != nil {
+		return fmt.Errorf("create staging directory: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			os.RemoveAll(staging)
+		}
+	}()
+	// MkdirTemp leaves the directory readable by its owner only.
+	if err := os.Chmod(staging, 0755); err != nil {
+		return err
+	}
+	if err := unzip(ctx, zipPath, staging); err != nil {
+		return err
+	}
+
+	if err := lock.CheckFence(ctx); err != nil {
+		return err
+	}
+	if entries, err := os.ReadDir(sitePath); err == nil {
+		if len(entries) > 0 {
+			aside := filepath.Join(parent, fmt.Sprintf("%s%s-%d", incompletePrefix, filepath.Base(sitePath), time.Now().UnixNano()))
+			log.Printf("worker: moving incomplete install of site %s aside to %s; remove it once checked", site.ID(), aside)
+			if err := os.Rename(sitePath, aside); err != nil {
+				return fmt.Errorf("move incomplete install aside: %w", err)
+			}
+		} else if err := os.Remove(sitePath); err != nil {
+			return fmt.Errorf("remove empty site directory: %w", err)
+		}
+	}
+	if err := os.Rename(staging, sitePath); err != nil {
+		return err
+	}
+	committed = true
+	// A crash before the marker is written leaves a complete site with
+	// wp-settings.php, which the next run marks installed.
+	return writeInstalledMarker(marker)
+}
+
+// writeInstalledMarker writes the completion marker at path.
+func writeInstalledMarker(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	stamp := time.Now().UTC().Format(time.RFC3339) + "\n"
+	return os.WriteFile(path, []byte(stamp), 0644)
+}
+
+const (
+	// stagingPrefix and incompletePrefix start the names of the directories
+	// installs extract WordPress into and move incomplete sites aside to,
+	// followed by the site directory's name, a dash and a number.
+	stagingPrefix    = ".staging-"
+	incompletePrefix = ".incomplete-"
+)
+
+// leftoverSite returns the name of the site directory a staging directory
+// under the base path was made for, and whether name is one.
+func leftoverSite(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, stagingPrefix)
+	if !ok {
+		return "", false
+	}
+	i := strings.LastIndexByte(rest, '-')
+	if i <= 0 || i == len(rest)-1 || strings.Trim(rest[i+1:], "0123456789") != "" {
+		return "", false
+	}
+	return rest[:i], true
+}
+
+// sweepLeftovers removes the staging directories under the base path left
+// behind by installs that never completed, e.g. because the process crashed.
+// Incomplete sites moved aside are left to the operator. Those of a configured site are only removed while its
+// domain's lock is held, as its holder may be installing it; those of sites
+// no longer configured while the controller's lock is held.
+func sweepLeftovers(ctx context.Context, cfg *cfgpkg.Config) {
+	domains := map[string]string{}
+	for _, s := range cfg.Sites {
+		domains[s.ID()] = s.DomainName
+	}
+	base := cfg.WordpressGlobal.BasePath
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		log.Printf("worker: failed to list %s for leftover installs: %v", base, err)
+		return
+	}
+	for _, e := range entries {
+		id, ok := leftoverSite(e.Name())
+		if !ok || !e.IsDir() {
+			continue
+		}
+		fenced := ctx
+		if domain, ok := domains[id]; ok {
+			if !lock.Holds(ctx, domain) {
+				continue
+			}
+			fenced = lock.ForSite(ctx, domain)
+		}
+		if lock.CheckFence(fenced) != nil {
+			continue
+		}
+		path := filepath.Join(base, e.Name())
+		log.Printf("worker: removing leftover install directory %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("worker: failed to remove %s: %v", path, err)
+		}
+	}
+}
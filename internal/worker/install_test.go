@@ -0,0 +1,172 @@
+package worker
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/eryalito/multi-wordpress-file-manager/internal/lock"
+	cfgpkg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// wordpressZip returns a minimal WordPress archive.
+func wordpressZip(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"wordpress/", "wordpress/wp-settings.php", "wordpress/wp-includes/version.php"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name[len(name)-1] != '/' {
+			w.Write([]byte("<?php\n"))
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCorruptArchiveIsDownloadedAgain(t *testing.T) {
+	good := wordpressZip(t)
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Write(good)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	wp := archive{path: filepath.Join(dir, "wordpress.zip"), url: srv.URL}
+	// A download cut off halfway.
+	if err := os.WriteFile(wp.path, good[:len(good)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	site := cfgpkg.Site{DomainName: "site1.example.com"}
+	sitePath := filepath.Join(dir, "sites", site.ID())
+	marker := filepath.Join(dir, "installed", site.ID())
+
+	err := ensureInstalled(context.Background(), wp, site, sitePath, marker)
+	if err == nil {
+		t.Fatal("install from a truncated archive succeeded")
+	}
+	if isPermanent(err) {
+		t.Fatalf("corrupt archive error is permanent: %v", err)
+	}
+	if _, err := os.Stat(wp.path); !os.IsNotExist(err) {
+		t.Fatalf("corrupt archive not removed: %v", err)
+	}
+
+	if err := ensureInstalled(context.Background(), wp, site, sitePath, marker); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if downloads != 1 {
+		t.Errorf("archive downloaded %d times, want 1", downloads)
+	}
+	for _, path := range []string{filepath.Join(sitePath, "wp-settings.php"), filepath.Join(sitePath, "wp-includes/version.php"), marker} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("retry did not install %s: %v", path, err)
+		}
+	}
+}
+
+func TestExistingSiteIsOnlyMarked(t *testing.T) {
+	dir := t.TempDir()
+	// Fetching the archive fails, so it must not be needed.
+	wp := archive{path: filepath.Join(dir, "wordpress.zip"), url: "http://127.0.0.1:0/wordpress.zip"}
+	site := cfgpkg.Site{DomainName: "site1.example.com"}
+	sitePath := filepath.Join(dir, "sites", site.ID())
+	marker := filepath.Join(dir, "installed", site.ID())
+	if err := os.MkdirAll(sitePath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sitePath, "wp-settings.php"), []byte("<?php\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ensureInstalled(context.Background(), wp, site, sitePath, marker); err != nil {
+		t.Fatalf("ensureInstalled: %v", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("existing site not marked installed: %v", err)
+	}
+	entries, err := os.ReadDir(sitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("existing site changed: %d entries, want only wp-settings.php", len(entries))
+	}
+}
+
+func TestIncompleteSiteIsKeptAside(t *testing.T) {
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "wordpress.zip")
+	if err := os.WriteFile(zipPath, wordpressZip(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	site := cfgpkg.Site{DomainName: "site1.example.com"}
+	sitePath := filepath.Join(dir, "sites", site.ID())
+	marker := filepath.Join(dir, "installed", site.ID())
+	// A partial install someone uploaded files into.
+	if err := os.MkdirAll(filepath.Join(sitePath, "wp-content"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sitePath, "wp-content", "photo.jpg"), []byte("jpeg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := installWordPress(context.Background(), zipPath, site, sitePath, marker); err != nil {
+		t.Fatalf("installWordPress: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sitePath, "wp-settings.php")); err != nil {
+		t.Errorf("site not installed: %v", err)
+	}
+	aside, _ := filepath.Glob(filepath.Join(dir, "sites", ".incomplete-"+site.ID()+"-*", "wp-content", "photo.jpg"))
+	if len(aside) != 1 {
+		t.Errorf("incomplete install not kept aside: %v", aside)
+	}
+}
+
+func TestSweepLeftovers(t *testing.T) {
+	base := t.TempDir()
+	cfg := &cfgpkg.Config{
+		WordpressGlobal: cfgpkg.WordpressGlobal{BasePath: base},
+		Sites:           []cfgpkg.Site{{DomainName: "site1.example.com"}},
+	}
+	names := []string{
+		".staging-site1.example.com-123",
+		".staging-removed.example.com-789",
+		".incomplete-site1.example.com-456",
+		"site1.example.com",
+		".mwpfm",
+	}
+	for _, name := range names {
+		if err := os.Mkdir(filepath.Join(base, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ld := &lock.Leader{}
+	sweepLeftovers(lock.WithLeader(context.Background(), ld), cfg)
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(base, name)); err != nil {
+			t.Errorf("%s removed without the lock: %v", name, err)
+		}
+	}
+
+	sweepLeftovers(context.Background(), cfg)
+	for i, name := range names {
+		_, err := os.Stat(filepath.Join(base, name))
+		if removed := os.IsNotExist(err); removed != (i < 2) {
+			t.Errorf("%s: removed = %v", name, removed)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+
+	cfgpkg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// networkCheckTimeout bounds the database query checking for network tables.
+const networkCheckTimeout = 10 * time.Second
+
+// errNetworkPending is returned once wp-config.php allows a multisite network
+// whose tables are not created yet; the site is retried until they are.
+var errNetworkPending = errors.New("multisite network not created yet")
+
+// networkCreated reports whether the multisite network tables of a site
+// exist in its database; replaced in tests.
+var networkCreated = queryNetworkTables
+
+// queryNetworkTables looks up the tables WordPress creates along with a
+// multisite network.
+func queryNetworkTables(ctx context.Context, site cfgpkg.Site) (bool, error) {
+	db := site.Wordpress.Database
+	dsn := mysql.NewConfig()
+	dsn.User = db.User
+	dsn.Passwd = db.Password
+	dsn.Net = "tcp"
+	dsn.Addr = net.JoinHostPort(db.Host, strconv.Itoa(db.Port))
+	dsn.DBName = db.Name
+	dsn.Timeout = networkCheckTimeout
+	conn, err := sql.Open("mysql", dsn.FormatDSN())
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, networkCheckTimeout)
+	defer cancel()
+	var n int
+	err = conn.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = ? AND table_name IN ('wp_site', 'wp_sitemeta')",
+		db.Name).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("query network tables: %w", err)
+	}
+	return n == 2, nil
+}
+
+// networkReady reports whether the multisite network of a site is created:
+// wp-config.php, whose constants are given in current, already defines it or
+// its tables exist. A failed lookup counts as not created.
+func networkReady(ctx context.Context, site cfgpkg.Site, current map[string]string) bool {
+	if site.Network == nil {
+		return false
+	}
+	if current["MULTISITE"] == "true" {
+		return true
+	}
+	created, err := networkCreated(ctx, site)
+	if err != nil {
+		log.Printf("worker: failed to look up the multisite network of site %s: %v", site.ID(), err)
+		return false
+	}
+	return created
+}
+
+// networkPending returns errNetworkPending if the site's network is not
+// created yet.
+func networkPending(site cfgpkg.Site, created bool) error {
+	if site.Network == nil || created {
+		return nil
+	}
+	return fmt.Errorf("worker: %w for site %s; create it under Tools > Network Setup or with wp core multisite-convert", errNetworkPending, site.ID())
+}
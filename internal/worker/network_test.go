@@ -0,0 +1,108 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cfgpkg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// stubNetwork serves salts locally and reports the network tables as created
+// or not, or the lookup as failed, per *state.
+func stubNetwork(t *testing.T, state *string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"AUTH_KEY", "SECURE_AUTH_KEY", "LOGGED_IN_KEY", "NONCE_KEY"} {
+			fmt.Fprintf(w, "define('%s', 'salt');\n", name)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	prevURL, prevCreated := saltsURL, networkCreated
+	t.Cleanup(func() { saltsURL, networkCreated = prevURL, prevCreated })
+	saltsURL = srv.URL
+	networkCreated = func(context.Context, cfgpkg.Site) (bool, error) {
+		switch *state {
+		case "created":
+			return true, nil
+		case "down":
+			return false, errors.New("connection refused")
+		}
+		return false, nil
+	}
+}
+
+func TestFreshNetworkIsOnlyAllowed(t *testing.T) {
+	state := "missing"
+	stubNetwork(t, &state)
+	dir := t.TempDir()
+	site := cfgpkg.Site{DomainName: "example.com", Network: &cfgpkg.Network{Mode: cfgpkg.NetworkModeSubdomain}}
+	read := func() map[string]string {
+		t.Helper()
+		content, err := os.ReadFile(filepath.Join(dir, "wp-config.php"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parseWPConfig(content)
+	}
+
+	err := ensureWPConfig(context.Background(), dir, site, "")
+	if !errors.Is(err, errNetworkPending) {
+		t.Fatalf("ensureWPConfig = %v, want the network pending", err)
+	}
+	if isPermanent(err) {
+		t.Errorf("pending network is not retried: %v", err)
+	}
+	current := read()
+	if current["WP_ALLOW_MULTISITE"] != "true" {
+		t.Error("fresh wp-config.php does not allow the network")
+	}
+	for _, name := range []string{"MULTISITE", "DOMAIN_CURRENT_SITE", "SITE_ID_CURRENT_SITE"} {
+		if _, ok := current[name]; ok {
+			t.Errorf("fresh wp-config.php defines %s before the network tables exist", name)
+		}
+	}
+
+	state = "created"
+	if err := ensureWPConfig(context.Background(), dir, site, ""); err != nil {
+		t.Fatalf("ensureWPConfig once created: %v", err)
+	}
+	current = read()
+	for name, want := range map[string]string{"MULTISITE": "true", "SUBDOMAIN_INSTALL": "true", "DOMAIN_CURRENT_SITE": "example.com"} {
+		if current[name] != want {
+			t.Errorf("%s = %q once the network is created, want %q", name, current[name], want)
+		}
+	}
+
+	// A network in use stays defined when the database cannot be reached.
+	state = "down"
+	if err := ensureWPConfig(context.Background(), dir, site, ""); err != nil {
+		t.Fatalf("ensureWPConfig with the database down: %v", err)
+	}
+	if read()["MULTISITE"] != "true" {
+		t.Error("network constants removed while the database was down")
+	}
+}
+
+func TestFreshInstallOfExistingNetwork(t *testing.T) {
+	state := "created"
+	stubNetwork(t, &state)
+	dir := t.TempDir()
+	site := cfgpkg.Site{DomainName: "example.com", Network: &cfgpkg.Network{Mode: cfgpkg.NetworkModeSubdirectory}}
+
+	if err := ensureWPConfig(context.Background(), dir, site, ""); err != nil {
+		t.Fatalf("ensureWPConfig: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "wp-config.php"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current := parseWPConfig(content); current["MULTISITE"] != "true" || current["SUBDOMAIN_INSTALL"] != "false" {
+		t.Errorf("wp-config.php of a network whose tables exist: MULTISITE %q, SUBDOMAIN_INSTALL %q", current["MULTISITE"], current["SUBDOMAIN_INSTALL"])
+	}
+}
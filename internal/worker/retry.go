@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"errors"
+	"math/rand/v2"
+	"text/template"
+	"time"
+
+	cfgpkg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// Delays between retries of a failed domain: the first retry waits about
+// retryBaseDelay, and each one after that twice as long, up to retryMaxDelay.
+const (
+	retryBaseDelay = 10 * time.Second
+	retryMaxDelay  = 15 * time.Minute
+)
+
+// permanentError marks an error that retrying cannot fix until the
+// configuration changes.
+type permanentError struct{ error }
+
+func (e permanentError) Unwrap() error { return e.error }
+
+func permanent(err error) error { return permanentError{err} }
+
+// isPermanent reports whether err cannot be fixed by retrying: it was marked
+// permanent, or a template failed to render the configuration. A corrupt
+// WordPress archive is not permanent, as it is downloaded again.
+func isPermanent(err error) bool {
+	var perm permanentError
+	var exec template.ExecError
+	return errors.As(err, &perm) || errors.As(err, &exec)
+}
+
+// failure is the retry state of a domain whose reconcile failed.
+type failure struct {
+	// fingerprint identifies the configuration of the domain the failure
+	// happened with; a change resets the state.
+	fingerprint string
+	attempts    int
+	permanent   bool
+	next        time.Time
+	err         error
+}
+
+// retries tracks the domains whose reconcile failed.
+type retries map[string]*failure
+
+// pending returns the failure of domain if it is not due for a retry yet.
+func (r retries) pending(domain, fingerprint string, now time.Time) *failure {
+	f := r[domain]
+	if f == nil {
+		return nil
+	}
+	if f.fingerprint != fingerprint {
+		delete(r, domain)
+		return nil
+	}
+	if f.permanent || now.Before(f.next) {
+		return f
+	}
+	return nil
+}
+
+// fail records a failed reconcile of domain and returns its state.
+func (r retries) fail(domain, fingerprint string, err error, now time.Time) *failure {
+	f := r[domain]
+	if f == nil || f.fingerprint != fingerprint {
+		f = &failure{fingerprint: fingerprint}
+		r[domain] = f
+	}
+	f.attempts++
+	f.err = err
+	f.permanent = isPermanent(err)
+	f.next = now.Add(backoff(f.attempts))
+	return f
+}
+
+// prune forgets the domains not in keep.
+func (r retries) prune(keep map[string]bool) {
+	for domain := range r {
+		if !keep[domain] {
+			delete(r, domain)
+		}
+	}
+}
+
+// backoff returns the delay before the retry following the given number of
+// failed attempts, doubling from retryBaseDelay up to retryMaxDelay, with
+// jitter so replicas and domains failing together do not retry in lockstep.
+func backoff(attempts int) time.Duration {
+	d := retryBaseDelay
+	for i := 1; i < attempts && d < retryMaxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, retryMaxDelay)
+	return d/2 + rand.N(d/2+1)
+}
+
+// fingerprint identifies the configuration a domain is reconciled with: its
+// sites and the global settings.
+func fingerprint(cfg *cfgpkg.Config, group []cfgpkg.Site) string {
+	return digest(group) + digest(globalsOf(cfg))
+}
@@ -0,0 +1,107 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/eryalito/multi-wordpress-file-manager/internal/certs"
+	cfgpkg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
+)
+
+// stateDir returns the directory on the shared volume where the controller
+// keeps its own state, such as generated certificates. It lives next to the
+// site directories and is never used as a document root.
+func stateDir(cfg *cfgpkg.Config) string {
+	return filepath.Join(cfg.WordpressGlobal.BasePath, ".mwpfm")
+}
+
+// ensureCertificates issues or renews the certificate of sites whose TLS mode
+// makes the controller responsible for it, and returns TLS settings pointing
+// at the issued files. Settings of other sites are returned unchanged.
+// Without issue, the certificate is left to the member holding the site's
+// lock: the files issued so far are used if valid, and pending reports that
+// they are not, in which case the site is to be served over plain HTTP.
+// Files are only written while the lock carried by ctx is held.
+func ensureCertificates(ctx context.Context, cfg *cfgpkg.Config, site cfgpkg.Site, issue bool) (tls *cfgpkg.TLS, pending bool, err error) {
+	if site.TLS == nil {
+		return nil, false, nil
+	}
+	var ca *certs.CA
+	switch site.TLS.Mode {
+	case cfgpkg.TLSModeACME:
+		// Keep serving the current certificate while a renewal is pending;
+		// without one the site is served over plain HTTP until it is issued.
+		certFile, keyFile := acmeCertFiles(cfg, site)
+		if err := certs.Validate(certFile, keyFile, site.Hostnames()); err != nil {
+			return &cfgpkg.TLS{Mode: cfgpkg.TLSModeACME}, !issue, nil
+		}
+		return &cfgpkg.TLS{Mode: cfgpkg.TLSModeACME, CertFile: certFile, KeyFile: keyFile}, false, nil
+	case cfgpkg.TLSModeSelfSigned:
+	case cfgpkg.TLSModeLocalCA:
+		if !issue {
+			break
+		}
+		ca, err = certs.EnsureCA(ctx, filepath.Join(stateDir(cfg), "ca"))
+		if err != nil {
+			return nil, false, fmt.Errorf("local ca: %w", err)
+		}
+	default:
+		return site.TLS, false, nil
+	}
+
+	dir := filepath.Join(stateDir(cfg), "certs", site.DomainName)
+	if !issue {
+		certFile, keyFile := filepath.Join(dir, certs.CertFileName), filepath.Join(dir, certs.KeyFileName)
+		if err := certs.Validate(certFile, keyFile, site.Hostnames()); err != nil {
+			return nil, true, nil
+		}
+		return &cfgpkg.TLS{Mode: site.TLS.Mode, CertFile: certFile, KeyFile: keyFile}, false, nil
+	}
+	certFile, keyFile, err := certs.EnsureCertificate(ctx, dir, site.Hostnames(), ca)
+	if err != nil {
+		return nil, false, err
+	}
+	return &cfgpkg.TLS{Mode: site.TLS.Mode, CertFile: certFile, KeyFile: keyFile}, false, nil
+}
+
+// acmeIssuer returns the ACME issuer configured for cfg, keeping its state on
+// the shared volume.
+func acmeIssuer(cfg *cfgpkg.Config) *certs.ACMEIssuer {
+	host, _ := os.Hostname()
+	return &certs.ACMEIssuer{
+		DirectoryURL: cfg.ACME.DirectoryURL,
+		Email:        cfg.ACME.Email,
+		CAFile:       cfg.ACME.CAFile,
+		StateDir:     filepath.Join(stateDir(cfg), "acme"),
+		Member:       host,
+	}
+}
+
+func acmeCertFiles(cfg *cfgpkg.Config, site cfgpkg.Site) (certFile, keyFile string) {
+	dir := filepath.Join(stateDir(cfg), "certs", site.DomainName)
+	return filepath.Join(dir, certs.CertFileName), filepath.Join(dir, certs.KeyFileName)
+}
+
+// needsACMECertificate reports whether a certificate has to be ordered for
+// site before it can be served over HTTPS, or because it is due for renewal.
+func needsACMECertificate(cfg *cfgpkg.Config, site cfgpkg.Site) bool {
+	if site.TLS == nil || site.TLS.Mode != cfgpkg.TLSModeACME {
+		return false
+	}
+	certFile, keyFile := acmeCertFiles(cfg, site)
+	return certs.NeedsRenewal(certFile, keyFile, site.Hostnames())
+}
+
+// obtainACMECertificate orders a certificate for site and returns TLS
+// settings pointing at it. The site must already be served over HTTP so the
+// CA can fetch the challenge responses.
+func obtainACMECertificate(ctx context.Context, cfg *cfgpkg.Config, site cfgpkg.Site) (*cfgpkg.TLS, error) {
+	dir := filepath.Join(stateDir(cfg), "certs", site.DomainName)
+	certFile, keyFile, err := acmeIssuer(cfg).Obtain(ctx, dir, site.Hostnames())
+	if err != nil {
+		return nil, err
+	}
+	return &cfgpkg.TLS{Mode: cfgpkg.TLSModeACME, CertFile: certFile, KeyFile: keyFile}, nil
+}
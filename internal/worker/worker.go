@@ -2,23 +2,39 @@ package worker
 
 import (
 	"context"
+	"sort"
+	"sync"
 	"time"
 
 	cfgpkg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
 )
 
 // WorkFunc is the function executed by the worker each cycle.
-// It receives the current config snapshot at execution time.
-type WorkFunc func(ctx context.Context, cfg *cfgpkg.Config) error
+// It receives the current config snapshot at execution time, and the domains
+// whose sites are to be reconciled, or nil for every site.
+type WorkFunc func(ctx context.Context, cfg *cfgpkg.Config, domains []string) error
 
-// Worker runs a function on a fixed interval and can be externally triggered.
-// Triggers are coalesced so that at most one pending run is queued.
+// Worker runs a function on a fixed interval and can be externally triggered,
+// for every site or for the sites of a domain. Triggers are queued until the
+// next run, with duplicates coalesced, and a full run covers every queued
+// domain.
 type Worker struct {
 	fn       WorkFunc
 	getCfg   func() *cfgpkg.Config
 	interval time.Duration
-	reqCh    chan struct{}
 	logf     func(string, ...any)
+
+	mu      sync.Mutex
+	all     bool
+	pending map[string]bool
+	// wake is signaled when triggers are queued; it holds at most one
+	// signal, as a run takes every queued trigger.
+	wake chan struct{}
+	// timers are the delayed triggers not yet fired, stopped by Stop.
+	timers map[*time.Timer]struct{}
+
+	quit     chan struct{}
+	quitOnce sync.Once
 }
 
 // New creates a new Worker.
@@ -33,42 +49,130 @@ func New(fn WorkFunc, getCfg func() *cfgpkg.Config, interval time.Duration, logf
 		fn:       fn,
 		getCfg:   getCfg,
 		interval: interval,
-		reqCh:    make(chan struct{}, 1),
 		logf:     logf,
+		pending:  map[string]bool{},
+		timers:   map[*time.Timer]struct{}{},
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
 	}
 }
 
-// Start runs the worker loop until ctx is canceled.
+// Start runs the worker loop until ctx is canceled, which also aborts the run
+// in progress, or Stop is called.
 func (w *Worker) Start(ctx context.Context) {
 	ticker := time.NewTicker(w.interval)
 	defer ticker.Stop()
 
 	// initial run
-	w.tryTrigger()
+	w.Trigger()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-w.quit:
+			return
 		case <-ticker.C:
-			w.tryTrigger()
-		case <-w.reqCh:
-			// Execute the work synchronously; additional triggers are coalesced
-			// because reqCh is size 1.
-			if err := w.fn(ctx, w.getCfg()); err != nil {
+			w.Trigger()
+		case <-w.wake:
+			if w.stopped() {
+				return
+			}
+			// Execute the work synchronously; triggers queued meanwhile are
+			// taken by the next run.
+			domains, ok := w.take()
+			if !ok {
+				continue
+			}
+			if err := w.fn(ctx, w.getCfg(), domains); err != nil {
 				w.logf("worker run error: %v", err)
 			}
 		}
 	}
 }
 
-// Trigger requests an immediate run (coalesced).
-func (w *Worker) Trigger() { w.tryTrigger() }
+// Stop stops the worker from starting new runs and cancels the delayed
+// triggers. A run in progress is not interrupted; Start returns once it is
+// done.
+func (w *Worker) Stop() {
+	w.quitOnce.Do(func() { close(w.quit) })
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for t := range w.timers {
+		t.Stop()
+	}
+	clear(w.timers)
+}
 
-func (w *Worker) tryTrigger() {
+func (w *Worker) stopped() bool {
 	select {
-	case w.reqCh <- struct{}{}:
+	case <-w.quit:
+		return true
 	default:
-		// already a run pending or in progress; coalesce
+		return false
+	}
+}
+
+// Trigger requests an immediate run for every site (coalesced).
+func (w *Worker) Trigger() { w.enqueue("") }
+
+// TriggerSite requests an immediate run for the sites of domain (coalesced).
+func (w *Worker) TriggerSite(domain string) { w.enqueue(domain) }
+
+// TriggerSiteAfter requests a run for the sites of domain after d, e.g. to
+// retry them before the next interval. It does nothing once the worker is
+// stopped.
+func (w *Worker) TriggerSiteAfter(domain string, d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped() {
+		return
+	}
+	var t *time.Timer
+	// The timer cannot remove itself before it is added: its func waits for
+	// mu.
+	t = time.AfterFunc(d, func() {
+		w.mu.Lock()
+		delete(w.timers, t)
+		w.mu.Unlock()
+		w.enqueue(domain)
+	})
+	w.timers[t] = struct{}{}
+}
+
+// enqueue queues a run for domain, or for every site if domain is empty.
+func (w *Worker) enqueue(domain string) {
+	if w.stopped() {
+		return
+	}
+	w.mu.Lock()
+	if domain == "" {
+		w.all = true
+	} else {
+		w.pending[domain] = true
+	}
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+		// already signaled; the queued triggers are taken together
+	}
+}
+
+// take empties the queue and returns the domains to run for, nil for every
+// site, and whether anything was queued.
+func (w *Worker) take() (domains []string, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	all := w.all
+	for d := range w.pending {
+		domains = append(domains, d)
+	}
+	w.all = false
+	clear(w.pending)
+	if all {
+		return nil, true
 	}
+	sort.Strings(domains)
+	return domains, len(domains) > 0
 }
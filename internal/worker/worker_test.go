@@ -0,0 +1,21 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStopCancelsDelayedTriggers(t *testing.T) {
+	w := New(nil, nil, time.Hour, nil)
+	w.TriggerSiteAfter("site1.example.com", 10*time.Millisecond)
+	w.Stop()
+	w.TriggerSiteAfter("site2.example.com", 0)
+
+	time.Sleep(50 * time.Millisecond)
+	if domains, ok := w.take(); ok {
+		t.Errorf("triggers queued after Stop: %v", domains)
+	}
+	if n := len(w.timers); n != 0 {
+		t.Errorf("%d timer(s) left after Stop", n)
+	}
+}
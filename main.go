@@ -3,62 +3,163 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/eryalito/multi-wordpress-file-manager/internal/certs"
 	internalCfg "github.com/eryalito/multi-wordpress-file-manager/internal/config"
 	"github.com/eryalito/multi-wordpress-file-manager/internal/lock"
+	"github.com/eryalito/multi-wordpress-file-manager/internal/shard"
 	"github.com/eryalito/multi-wordpress-file-manager/internal/worker"
 	publicCfg "github.com/eryalito/multi-wordpress-file-manager/pkg/config"
 )
 
-func parseFlags() (cfgPath string, lockPath string, member string, lockTimeout *time.Duration, interval *time.Duration) {
+// lockFlags select and tune the lock keeping replicas from reconciling at
+// the same time.
+type lockFlags struct {
+	backend   string
+	path      string
+	namespace string
+	name      string
+	timeout   time.Duration
+	ttl       time.Duration
+	shard     string
+}
+
+// rebalanceInterval is how often a sharded controller rebalances its domains
+// with the other members of its shard.
+const rebalanceInterval = 15 * time.Second
+
+func parseFlags() (cfgPath string, member string, lf lockFlags, interval, grace *time.Duration) {
 	cfg := flag.String("config", "config.yaml", "Path to YAML configuration file")
-	lockP := flag.String("lock", "", "Path to lock file on shared filesystem (optional; defaults next to config)")
+	flag.StringVar(&lf.backend, "lock-backend", "file", "Lock backend: file (flock on a shared filesystem) or k8s-lease (coordination.k8s.io Lease)")
+	flag.StringVar(&lf.path, "lock", "", "Path to lock file on shared filesystem (optional; defaults next to config)")
+	flag.StringVar(&lf.namespace, "lock-namespace", "", "Namespace of the Lease (defaults to the pod's namespace)")
+	flag.StringVar(&lf.name, "lock-name", "multi-wordpress", "Name of the Lease")
 	mem := flag.String("member", "", "Identifier for this instance (defaults to hostname)")
-	lto := flag.Duration("lock-timeout", 0, "Max time to wait to acquire the lock (0=wait forever)")
+	flag.DurationVar(&lf.timeout, "lock-timeout", 0, "Max time to wait to acquire the lock (0=wait forever)")
+	flag.DurationVar(&lf.ttl, "lock-ttl", 0, "Lease TTL: take over a lock whose holder has not refreshed it for this long (0=disabled)")
+	flag.StringVar(&lf.shard, "shard", "", "Reconcile only the domains selected by all, hash:i/n or label:key=value, split through per-site locks with the controllers using the same selector (default: one lock for all sites)")
 	iv := flag.Duration("interval", 3*time.Minute, "Worker interval (e.g. 3m, 30s)")
+	gr := flag.Duration("shutdown-grace", 20*time.Second, "On shutdown, time given to a run in progress to finish before it is aborted")
 	flag.Parse()
-	return *cfg, *lockP, *mem, lto, iv
+	return *cfg, *mem, lf, iv, gr
 }
 
 func setupContext() (context.Context, context.CancelFunc) {
 	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 }
 
-func acquireLock(ctx context.Context, cfgPath, lockPath, member string, lockTimeout *time.Duration) (context.Context, func(), error) {
-	lp := lockPath
-	if lp == "" {
-		lp = filepath.Join(filepath.Dir(cfgPath), ".multi-wordpress-file-manager.lock")
-	}
-	m := member
-	if m == "" {
-		if h, err := os.Hostname(); err == nil {
-			m = h
-		}
-	}
+// acquireLock waits for the lock of the configured backend.
+func acquireLock(ctx context.Context, cfgPath, member string, lf lockFlags) (*lock.Lock, error) {
+	m := memberName(member)
 	lockCtx := ctx
-	if *lockTimeout > 0 {
+	if lf.timeout > 0 {
 		var cancel context.CancelFunc
-		lockCtx, cancel = context.WithTimeout(ctx, *lockTimeout)
+		lockCtx, cancel = context.WithTimeout(ctx, lf.timeout)
 		defer cancel()
 	}
-	rel, err := lock.Acquire(lockCtx, lp, m)
+
+	var (
+		l    *lock.Lock
+		err  error
+		desc string
+	)
+	switch lf.backend {
+	case "file":
+		lp := lf.path
+		if lp == "" {
+			lp = defaultLockPath(cfgPath)
+		}
+		l, err = lock.Acquire(lockCtx, lp, m, lock.Options{TTL: lf.ttl, Logf: log.Printf})
+		desc = lp
+	case "k8s-lease":
+		client, ns, cerr := kubeClient()
+		if cerr != nil {
+			return nil, cerr
+		}
+		if lf.namespace != "" {
+			ns = lf.namespace
+		}
+		l, err = lock.AcquireLease(lockCtx, client, m, lock.LeaseOptions{Namespace: ns, Name: lf.name})
+		desc = fmt.Sprintf("lease %s/%s", ns, lf.name)
+	default:
+		return nil, fmt.Errorf("unknown lock backend %q", lf.backend)
+	}
 	if err != nil {
-		return ctx, nil, err
+		return nil, err
 	}
-	cleanup := func() {
-		if err := rel(); err != nil {
-			log.Printf("lock release error: %v", err)
+	log.Printf("acquired lock: %s (fencing token %d)", desc, l.Token())
+	return l, nil
+}
+
+// siteLockBackend returns the backend keeping the per-site locks of sharded
+// controllers: files in a directory next to the lock file, or Leases named
+// after the lock's.
+func siteLockBackend(cfgPath string, lf lockFlags) (lock.Backend, error) {
+	switch lf.backend {
+	case "file":
+		lp := lf.path
+		if lp == "" {
+			lp = defaultLockPath(cfgPath)
+		}
+		return lock.FileBackend{Dir: lp + ".d", Options: lock.Options{TTL: lf.ttl, Logf: log.Printf}}, nil
+	case "k8s-lease":
+		client, ns, err := kubeClient()
+		if err != nil {
+			return nil, err
 		}
+		if lf.namespace != "" {
+			ns = lf.namespace
+		}
+		return lock.LeaseBackend{Client: client, Options: lock.LeaseOptions{Namespace: ns, Name: lf.name}}, nil
+	default:
+		return nil, fmt.Errorf("unknown lock backend %q", lf.backend)
+	}
+}
+
+// memberName returns member, or the hostname if it is empty.
+func memberName(member string) string {
+	if member == "" {
+		if h, err := os.Hostname(); err == nil {
+			return h
+		}
+	}
+	return member
+}
+
+// defaultLockPath returns the lock file used when -lock is not set.
+func defaultLockPath(cfgPath string) string {
+	return filepath.Join(filepath.Dir(cfgPath), ".multi-wordpress-file-manager.lock")
+}
+
+// kubeClient returns a client for the cluster the process runs in, and the
+// namespace of its pod.
+func kubeClient() (kubernetes.Interface, string, error) {
+	rc, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("kubernetes config: %w", err)
 	}
-	log.Printf("acquired lock: %s", lp)
-	return ctx, cleanup, nil
+	client, err := kubernetes.NewForConfig(rc)
+	if err != nil {
+		return nil, "", fmt.Errorf("kubernetes client: %w", err)
+	}
+	ns := os.Getenv("POD_NAMESPACE")
+	if ns == "" {
+		b, _ := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+		ns = strings.TrimSpace(string(b))
+	}
+	return client, ns, nil
 }
 
 func loadInitialConfig(cfgPath string) *publicCfg.Config {
@@ -71,10 +172,73 @@ func loadInitialConfig(cfgPath string) *publicCfg.Config {
 	return cfg
 }
 
-func startWorker(ctx context.Context, currentCfg func() *publicCfg.Config, interval *time.Duration) *worker.Worker {
-	w := worker.New(worker.Handle, currentCfg, *interval, log.Printf)
-	go w.Start(ctx)
-	return w
+// controller is a running worker with the watchers triggering it.
+type controller struct {
+	w    *worker.Worker
+	done <-chan struct{}
+}
+
+// startController loads the configuration into cfgVal and starts the worker
+// and the watchers keeping it current, until ctx is canceled.
+func startController(ctx context.Context, cfgPath string, cfgVal *atomic.Value, interval *time.Duration) *controller {
+	cfg := loadInitialConfig(cfgPath)
+	cfgVal.Store(cfg)
+
+	h := worker.NewHandler()
+	w := worker.New(h.Handle, func() *publicCfg.Config { return currentConfig(cfgVal) }, *interval, log.Printf)
+	h.Retry = w.TriggerSiteAfter
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Start(ctx)
+	}()
+
+	stopCertWatcher := startCertWatcher(ctx, cfg, w.Trigger)
+	if err := startWatcher(ctx, cfgPath, func(c *publicCfg.Config) {
+		old := currentConfig(cfgVal)
+		cfgVal.Store(c)
+		stopCertWatcher()
+		stopCertWatcher = startCertWatcher(ctx, c, w.Trigger)
+		// Only the domains whose sites changed are reconciled, unless
+		// settings shared by every site changed.
+		domains, all := worker.ChangedDomains(old, c)
+		if all {
+			w.Trigger()
+			return
+		}
+		for _, d := range domains {
+			w.TriggerSite(d)
+		}
+	}); err != nil {
+		log.Fatalf("watch start: %v", err)
+	}
+	log.Printf("watching %s for changes...", cfgPath)
+	return &controller{w: w, done: done}
+}
+
+// shutdown stops the worker from starting new runs and gives the run in
+// progress, if any, grace to finish before calling cancel, which cancels the
+// controller's context and aborts the run. It returns once the worker has
+// stopped.
+func (c *controller) shutdown(cancel context.CancelFunc, grace time.Duration) {
+	c.w.Stop()
+	if grace > 0 {
+		select {
+		case <-c.done:
+		case <-time.After(grace):
+			log.Printf("shutdown grace period of %s over; aborting the run in progress", grace)
+		}
+	}
+	cancel()
+	<-c.done
+}
+
+func currentConfig(cfgVal *atomic.Value) *publicCfg.Config {
+	v := cfgVal.Load()
+	if v == nil {
+		return nil
+	}
+	return v.(*publicCfg.Config)
 }
 
 func startWatcher(ctx context.Context, cfgPath string, onReload func(*publicCfg.Config)) error {
@@ -89,38 +253,165 @@ func startWatcher(ctx context.Context, cfgPath string, onReload func(*publicCfg.
 	return err
 }
 
+// startCertWatcher watches the directories holding the sites' TLS certificates
+// and calls trigger when they change, so renewed certificates are validated
+// and picked up without waiting for the next interval. The returned function
+// stops the watcher.
+func startCertWatcher(ctx context.Context, cfg *publicCfg.Config, trigger func()) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	if cfg == nil {
+		return cancel
+	}
+	seen := map[string]bool{}
+	var dirs []string
+	for _, site := range cfg.Sites {
+		if site.TLS == nil {
+			continue
+		}
+		certFile, keyFile, err := certs.Files(*site.TLS)
+		if err != nil {
+			continue
+		}
+		for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	if len(dirs) == 0 {
+		return cancel
+	}
+	if _, err := certs.Watch(ctx, dirs, trigger); err != nil {
+		log.Printf("certificate watch: %v", err)
+	}
+	return cancel
+}
+
+// commands are the subcommands run instead of the controller when named as
+// the first argument.
+var commands = map[string]func(args []string) int{
+	"cache":  runCache,
+	"export": runExport,
+	"lock":   runLock,
+}
+
 func main() {
-	cfgPath, lockPath, member, lockTimeout, interval := parseFlags()
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
+	cfgPath, member, lf, interval, grace := parseFlags()
 
 	ctx, cancel := setupContext()
 	defer cancel()
 
-	if _, cleanup, err := acquireLock(ctx, cfgPath, lockPath, member, lockTimeout); err != nil {
-		log.Fatalf("failed to acquire lock: %v", err)
-	} else {
-		defer cleanup()
+	if lf.shard != "" {
+		sel, err := shard.Parse(lf.shard)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := runShard(ctx, cfgPath, member, lf, sel, interval, *grace); err != nil {
+			log.Fatalf("shard %s: %v", sel, err)
+		}
+		log.Printf("shutting down")
+		return
 	}
 
+	// Every replica serves every site, so the controller renders the proxy
+	// and PHP-FPM configuration of the pod right away; shared storage is
+	// only written while the lock is held.
+	var leader lock.Leader
+	runCtx, stop := context.WithCancel(lock.WithLeader(context.WithoutCancel(ctx), &leader))
+	defer stop()
 	var cfgVal atomic.Value
-	cfg := loadInitialConfig(cfgPath)
-	cfgVal.Store(cfg)
+	c := startController(runCtx, cfgPath, &cfgVal, interval)
 
-	w := startWorker(ctx, func() *publicCfg.Config {
-		v := cfgVal.Load()
-		if v == nil {
-			return nil
+	l := lead(ctx, &leader, c.w.Trigger, cfgPath, member, lf)
+	c.shutdown(stop, *grace)
+	if l != nil {
+		leader.Set(nil)
+		if err := l.Release(); err != nil {
+			log.Printf("lock release error: %v", err)
 		}
-		return v.(*publicCfg.Config)
-	}, interval)
+	}
+	log.Printf("shutting down")
+}
 
-	if err := startWatcher(ctx, cfgPath, func(c *publicCfg.Config) {
-		cfgVal.Store(c)
-		w.Trigger()
-	}); err != nil {
-		log.Fatalf("watch start: %v", err)
+// lead competes for the lock until ctx is canceled, recording it in leader
+// while it is held. Each acquisition triggers a run, so shared storage is
+// reconciled by the new holder. A lost lock is released and waited for
+// again; the worker checks the lock's fencing token before each write, so
+// nothing is written to shared storage meanwhile, even by a run in progress.
+// It returns the lock held when ctx was canceled, if any, for the caller to
+// release once the worker has stopped.
+func lead(ctx context.Context, leader *lock.Leader, trigger func(), cfgPath, member string, lf lockFlags) *lock.Lock {
+	for {
+		l, err := acquireLock(ctx, cfgPath, member, lf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Fatalf("failed to acquire lock: %v", err)
+		}
+		leader.Set(l)
+		trigger()
+		select {
+		case <-ctx.Done():
+			return l
+		case <-l.Lost():
+		}
+		leader.Set(nil)
+		if err := l.Release(); err != nil {
+			log.Printf("lock release error: %v", err)
+		}
+		log.Printf("lock lost; stopped writing to shared storage, waiting for the lock again")
 	}
+}
 
-	log.Printf("watching %s for changes...", cfgPath)
-	<-ctx.Done()
-	log.Printf("shutting down")
+// runShard reconciles the domains selected by sel whose site lock this
+// member holds, until ctx is canceled. The domains are rebalanced with the
+// other members of the shard every rebalanceInterval, which also picks up
+// domains added to or removed from the configuration. On shutdown, a run in
+// progress gets grace to finish before the site locks are released.
+func runShard(ctx context.Context, cfgPath, member string, lf lockFlags, sel shard.Selector, interval *time.Duration, grace time.Duration) error {
+	backend, err := siteLockBackend(cfgPath, lf)
+	if err != nil {
+		return err
+	}
+	locks, err := lock.NewSiteLocks(ctx, backend, sel.Group(), memberName(member), log.Printf)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := locks.Release(); err != nil {
+			log.Printf("lock release error: %v", err)
+		}
+	}()
+	log.Printf("shard %s: joined as %s", sel, memberName(member))
+
+	runCtx, cancel := context.WithCancel(lock.WithSiteLocks(context.WithoutCancel(ctx), locks))
+	defer cancel()
+
+	var cfgVal atomic.Value
+	c := startController(runCtx, cfgPath, &cfgVal, interval)
+	ticker := time.NewTicker(rebalanceInterval)
+	defer ticker.Stop()
+	for {
+		// The worker's first run may miss the domains acquired here; they
+		// are reconciled by the triggered run.
+		if locks.Sync(ctx, sel.Domains(currentConfig(&cfgVal))) {
+			domains := locks.Domains()
+			log.Printf("shard %s: reconciling %d domain(s) %s", sel, len(domains), strings.Join(domains, ", "))
+			c.w.Trigger()
+		}
+		select {
+		case <-ctx.Done():
+			c.shutdown(cancel, grace)
+			return nil
+		case <-ticker.C:
+		}
+	}
 }
@@ -1,5 +1,7 @@
 package config
 
+import "strings"
+
 type ProxyType string
 
 var (
@@ -7,7 +9,161 @@ var (
 )
 
 type Proxy struct {
-	Type ProxyType `yaml:"type"` // e.g. "apache"
+	Type      ProxyType `yaml:"type"`       // e.g. "apache"
+	HTTPSPort int       `yaml:"https_port"` // port for TLS vhosts, defaults to 8443
+	// Defaults for every site, overridden by the site's own settings.
+	SecurityHeaders SecurityHeaders `yaml:"security_headers"`
+	Hardening       bool            `yaml:"hardening"`
+	FPM             FPM             `yaml:"fpm"`
+	Logging         Logging         `yaml:"logging"`
+	// DefaultSite, when set, has the controller manage the catch-all vhost
+	// answering requests for unknown hosts.
+	DefaultSite *DefaultSite `yaml:"default_site"`
+	// Traefik, when set, has the controller keep a Traefik file-provider
+	// configuration routing every site to the proxy.
+	Traefik *Traefik `yaml:"traefik"`
+}
+
+// Traefik configures the Traefik dynamic configuration file written by the
+// controller.
+type Traefik struct {
+	File         string   `yaml:"file"` // watched by Traefik's file provider
+	URL          string   `yaml:"url"`  // address of the proxy, e.g. http://multi-wordpress:80
+	EntryPoints  []string `yaml:"entry_points"`
+	CertResolver string   `yaml:"cert_resolver"` // enables TLS on the routers
+}
+
+var (
+	DefaultSiteDeny     = "deny"
+	DefaultSiteRedirect = "redirect"
+	DefaultSiteServe    = "serve"
+)
+
+type DefaultSite struct {
+	Mode string `yaml:"mode"` // "deny" (default), "redirect:<url>" or "serve:<domain>"
+	Page string `yaml:"page"` // custom HTML returned in deny mode
+}
+
+// Action splits Mode into the action and its argument, e.g. "redirect" and
+// the target URL.
+func (d DefaultSite) Action() (action, arg string) {
+	action, arg, _ = strings.Cut(d.Mode, ":")
+	if action == "" {
+		action = DefaultSiteDeny
+	}
+	return action, arg
+}
+
+type LogTarget string
+
+var (
+	LogTargetFile       LogTarget = "file"
+	LogTargetStdout     LogTarget = "stdout"
+	LogTargetStderr     LogTarget = "stderr"
+	LogTargetRotatelogs LogTarget = "rotatelogs"
+)
+
+type LogFormat string
+
+var (
+	LogFormatCombined LogFormat = "combined"
+	LogFormatJSON     LogFormat = "json"
+)
+
+// Logging selects where and how a site's access and error logs are written.
+type Logging struct {
+	Target   LogTarget `yaml:"target"`   // "file" (default), "stdout", "stderr" or "rotatelogs"
+	Format   LogFormat `yaml:"format"`   // access log format, "combined" (default) or "json"
+	Dir      string    `yaml:"dir"`      // log directory for file targets, defaults to ${APACHE_LOG_DIR}
+	Rotation string    `yaml:"rotation"` // rotatelogs interval in seconds or size such as 100M, defaults to 86400
+}
+
+// Merge returns l with every field set in override replacing its own.
+func (l Logging) Merge(override *Logging) Logging {
+	if override == nil {
+		return l
+	}
+	if override.Target != "" {
+		l.Target = override.Target
+	}
+	if override.Format != "" {
+		l.Format = override.Format
+	}
+	if override.Dir != "" {
+		l.Dir = override.Dir
+	}
+	if override.Rotation != "" {
+		l.Rotation = override.Rotation
+	}
+	return l
+}
+
+// FPM runs every site's PHP in its own PHP-FPM pool instead of mod_php.
+type FPM struct {
+	Enabled   bool   `yaml:"enabled"`
+	PoolDir   string `yaml:"pool_dir"`   // defaults to /etc/php/pools.d
+	SocketDir string `yaml:"socket_dir"` // defaults to /run/php
+	// TmpDir holds a temporary directory per site, used for uploads,
+	// sessions and temporary files. It must be shared by the controller and
+	// PHP-FPM; defaults to /var/lib/mwpfm/tmp.
+	TmpDir string `yaml:"tmp_dir"`
+	// RootMaster states that the PHP-FPM master process runs as root, which
+	// pools need to switch to their own user and group. The bundled image
+	// runs it as www-data.
+	RootMaster bool `yaml:"root_master"`
+}
+
+// FPMPool tunes the PHP-FPM pool of a site. Zero values use the defaults.
+type FPMPool struct {
+	User              string `yaml:"user"`  // defaults to www-data; others need FPM.RootMaster
+	Group             string `yaml:"group"` // defaults to www-data; others need FPM.RootMaster
+	PM                string `yaml:"pm"`    // "dynamic" (default), "static" or "ondemand"
+	MaxChildren       int    `yaml:"max_children"`
+	StartServers      int    `yaml:"start_servers"`
+	MinSpareServers   int    `yaml:"min_spare_servers"`
+	MaxSpareServers   int    `yaml:"max_spare_servers"`
+	MaxRequests       int    `yaml:"max_requests"`
+	UploadMaxFilesize string `yaml:"upload_max_filesize"` // e.g. 64M
+	MemoryLimit       string `yaml:"memory_limit"`        // e.g. 256M
+}
+
+type HSTS struct {
+	MaxAge            int  `yaml:"max_age"` // seconds
+	IncludeSubdomains bool `yaml:"include_subdomains"`
+	Preload           bool `yaml:"preload"`
+}
+
+// SecurityHeaders are response headers added by the proxy. Empty fields are
+// not sent.
+type SecurityHeaders struct {
+	HSTS                  *HSTS  `yaml:"hsts"`
+	FrameOptions          string `yaml:"frame_options"` // e.g. SAMEORIGIN
+	ContentSecurityPolicy string `yaml:"content_security_policy"`
+	ReferrerPolicy        string `yaml:"referrer_policy"`
+	PermissionsPolicy     string `yaml:"permissions_policy"`
+}
+
+// Merge returns h with every field set in override replacing its own.
+func (h SecurityHeaders) Merge(override *SecurityHeaders) SecurityHeaders {
+	if override == nil {
+		return h
+	}
+	if override.HSTS != nil {
+		h.HSTS = override.HSTS
+	}
+	if override.FrameOptions != "" {
+		h.FrameOptions = override.FrameOptions
+	}
+	if override.ContentSecurityPolicy != "" {
+		h.ContentSecurityPolicy = override.ContentSecurityPolicy
+	}
+	if override.ReferrerPolicy != "" {
+		h.ReferrerPolicy = override.ReferrerPolicy
+	}
+	if override.PermissionsPolicy != "" {
+		h.PermissionsPolicy = override.PermissionsPolicy
+	}
+	return h
 }
 
 type Database struct {
@@ -28,13 +184,172 @@ type WordpressGlobal struct {
 	BasePath string `yaml:"base_path"`
 }
 
+type TLSMode string
+
+var (
+	TLSModeFiles      TLSMode = "files"
+	TLSModeSelfSigned TLSMode = "self-signed"
+	TLSModeLocalCA    TLSMode = "local-ca"
+	TLSModeACME       TLSMode = "acme"
+)
+
+// TLS configures TLS termination for a site in the internal proxy. In the
+// default "files" mode either CertFile and KeyFile or Dir must be set. Dir is
+// expected to contain tls.crt and tls.key, matching the layout of a mounted
+// kubernetes.io/tls secret. The other modes have the controller issue the
+// certificate itself.
+type TLS struct {
+	Mode     TLSMode `yaml:"mode"` // "files" (default), "self-signed", "local-ca" or "acme"
+	CertFile string  `yaml:"cert_file"`
+	KeyFile  string  `yaml:"key_file"`
+	Dir      string  `yaml:"dir"`
+}
+
+// ACME configures the ACME account used for sites in "acme" TLS mode.
+type ACME struct {
+	Email        string `yaml:"email"`
+	DirectoryURL string `yaml:"directory_url"` // defaults to Let's Encrypt production
+	CAFile       string `yaml:"ca_file"`       // extra CA to trust for the directory, e.g. Pebble's
+}
+
+// Maintenance puts a site into maintenance mode at the proxy: every request
+// not coming from AllowIPs gets a 503 with a custom page.
+type Maintenance struct {
+	Enabled    bool     `yaml:"enabled"`
+	Message    string   `yaml:"message"`
+	AllowIPs   []string `yaml:"allow_ips"`   // IPs or CIDRs that bypass maintenance
+	RetryAfter int      `yaml:"retry_after"` // seconds, defaults to 600
+}
+
+// BasicAuthUser is a user allowed through HTTP basic auth. Exactly one of
+// Password (plaintext, hashed when written) or PasswordHash (bcrypt) is set.
+type BasicAuthUser struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordHash string `yaml:"password_hash"`
+}
+
+// Access restricts who can reach a site. Requests from Deny are always
+// rejected; otherwise a request must come from Allow or authenticate as one
+// of Users, whichever are configured. ExemptPaths bypass all restrictions.
+type Access struct {
+	Users       []BasicAuthUser `yaml:"users"`
+	Allow       []string        `yaml:"allow"`        // IPs or CIDRs
+	Deny        []string        `yaml:"deny"`         // IPs or CIDRs
+	ExemptPaths []string        `yaml:"exempt_paths"` // e.g. /wp-cron.php, /.well-known/
+}
+
+// Redirect sends requests for Source to Target. Source is an exact path, or a
+// regular expression matched against the path when Regex is set, in which
+// case Target may reference capture groups as $1, $2...
+type Redirect struct {
+	Source string `yaml:"source"`
+	Target string `yaml:"target"`
+	Status int    `yaml:"status"` // 301 (default), 302, 303, 307 or 308
+	Regex  bool   `yaml:"regex"`
+}
+
+// Cache enables a page cache in the proxy for anonymous traffic. Requests
+// carrying WordPress login, comment or cart cookies, the admin area and
+// non-GET requests always bypass it.
+type Cache struct {
+	Enabled       bool     `yaml:"enabled"`
+	TTL           int      `yaml:"ttl"`            // seconds, defaults to 300
+	BypassPaths   []string `yaml:"bypass_paths"`   // extra path prefixes never cached, e.g. /cart
+	BypassCookies []string `yaml:"bypass_cookies"` // extra cookie name prefixes that bypass the cache
+}
+
+type NetworkMode string
+
+var (
+	NetworkModeSubdomain    NetworkMode = "subdomain"
+	NetworkModeSubdirectory NetworkMode = "subdirectory"
+)
+
+// Network turns a site into a WordPress multisite network. Sites lists the
+// hostnames the network's sites are served at besides the domain name, such
+// as subdomains or mapped domains. In subdomain mode it defaults to a
+// wildcard for the domain.
+type Network struct {
+	Mode  NetworkMode `yaml:"mode"` // "subdomain" or "subdirectory"
+	Sites []string    `yaml:"sites"`
+}
+
 type Site struct {
-	DomainName string    `yaml:"domain_name"`
-	Wordpress  Wordpress `yaml:"wordpress"`
+	DomainName string `yaml:"domain_name"`
+	// PathPrefix serves the site under a path of its domain, e.g. /blog, next
+	// to other sites sharing the domain. The vhost-wide settings (aliases,
+	// tls, maintenance, redirects, security headers, hardening, logging and
+	// cache) are taken from the domain's primary site.
+	PathPrefix    string       `yaml:"path_prefix"`
+	Aliases       []string     `yaml:"aliases"`
+	Wordpress     Wordpress    `yaml:"wordpress"`
+	TLS           *TLS         `yaml:"tls"`
+	Maintenance   *Maintenance `yaml:"maintenance"`
+	Access        *Access      `yaml:"access"`
+	Redirects     []Redirect   `yaml:"redirects"`
+	RedirectsFile string       `yaml:"redirects_file"` // CSV of source,target[,status]; relative to the config file
+	// SecurityHeaders and Hardening override the proxy-wide defaults.
+	SecurityHeaders *SecurityHeaders `yaml:"security_headers"`
+	Hardening       *bool            `yaml:"hardening"`
+	FPM             *FPMPool         `yaml:"fpm"`
+	// PHP holds php.ini overrides, e.g. upload_max_filesize: 64M.
+	PHP map[string]string `yaml:"php"`
+	// Logging overrides the proxy-wide logging settings.
+	Logging *Logging `yaml:"logging"`
+	Cache   *Cache   `yaml:"cache"`
+	Network *Network `yaml:"network"`
+	// Labels are free-form key/value pairs, used to select the sites a
+	// controller reconciles with -shard label:key=value. Those of the
+	// domain's primary site apply to the whole domain.
+	Labels map[string]string `yaml:"labels"`
 }
 
 type Config struct {
 	Sites           []Site          `yaml:"sites"`
 	Proxy           Proxy           `yaml:"proxy"`
 	WordpressGlobal WordpressGlobal `yaml:"wordpress_global"`
+	ACME            ACME            `yaml:"acme"`
+}
+
+// Hostnames returns the site's domain name followed by its aliases and the
+// hostnames of its network's sites.
+func (s Site) Hostnames() []string {
+	names := append([]string{s.DomainName}, s.Aliases...)
+	if n := s.Network; n != nil {
+		if len(n.Sites) == 0 && n.Mode == NetworkModeSubdomain {
+			return append(names, "*."+s.DomainName)
+		}
+		names = append(names, n.Sites...)
+	}
+	return names
+}
+
+// ID identifies the site among the sites sharing its domain name: the domain
+// name, followed by the path prefix with slashes replaced by underscores. It
+// names the site's directory and the files kept for it.
+func (s Site) ID() string {
+	return s.DomainName + strings.ReplaceAll(s.PathPrefix, "/", "_")
+}
+
+// GroupByDomain groups sites sharing a domain name, in order of first
+// appearance. The first site of each group is the domain's primary site: the
+// one without a path prefix if there is one, otherwise the first listed.
+func GroupByDomain(sites []Site) [][]Site {
+	var groups [][]Site
+	index := map[string]int{}
+	for _, site := range sites {
+		i, ok := index[site.DomainName]
+		if !ok {
+			i = len(groups)
+			index[site.DomainName] = i
+			groups = append(groups, nil)
+		}
+		if site.PathPrefix == "" && len(groups[i]) > 0 && groups[i][0].PathPrefix != "" {
+			groups[i] = append([]Site{site}, groups[i]...)
+			continue
+		}
+		groups[i] = append(groups[i], site)
+	}
+	return groups
 }
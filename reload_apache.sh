@@ -24,5 +24,31 @@ while true; do
   reload_apache
 done &
 
+# Keep the page cache within its size limit; mod_cache_disk never removes
+# expired entries itself
+if [ -n "${CACHE_DIR:-}" ]; then
+  mkdir -p "$CACHE_DIR" \
+    || echo "[DEBUG] htcacheclean failed to start; the page cache is not cleaned"
+  echo "[DEBUG] Cleaning the page cache in $CACHE_DIR every ${CACHE_CLEAN_INTERVAL:-15} minutes, limit ${CACHE_LIMIT:-1G}"
+  htcacheclean -d "${CACHE_CLEAN_INTERVAL:-15}" -n -t -l "${CACHE_LIMIT:-1G}" -p "$CACHE_DIR" \
+    || echo "[DEBUG] htcacheclean failed to start; the page cache is not cleaned"
+fi
+
+# Start PHP-FPM when per-site pools are enabled, reloading it on pool changes
+if [ "${PHP_FPM:-0}" = "1" ]; then
+  echo "[DEBUG] Starting PHP-FPM..."
+  php-fpm8.3 --nodaemonize &
+  FPM_PID=$!
+  echo "[DEBUG] PHP-FPM started with PID $FPM_PID"
+
+  echo "[DEBUG] Monitoring /etc/php/pools.d for changes..."
+  while true; do
+    EVENT=$(inotifywait -e create -e delete -e modify -e move --format '%e %w%f' /etc/php/pools.d/)
+    echo "[DEBUG] Event detected: $EVENT"
+    echo "[DEBUG] Reloading PHP-FPM..."
+    kill -USR2 $FPM_PID
+  done &
+fi
+
 # Wait for the Apache process to exit
 wait $APACHE_PID